@@ -0,0 +1,460 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Publisher authentication types, see PublisherAuth.
+const (
+	// No credentials. PublisherAuth.Headers are still sent.
+	AuthNone = "none"
+	// The secret is sent as "Authorization: Bearer <secret>".
+	AuthBearer = "bearer"
+	// The secret is sent in the PublisherAuth.Header header.
+	AuthAPIKey = "api_key"
+	// An access token is requested from the token endpoint with a signed JWT client assertion, per
+	// https://hl7.org/fhir/uv/bulkdata/authorization/index.html, and sent as a bearer token.
+	AuthSMARTBackendServices = "smart_backend_services"
+)
+
+// JWT signing algorithms supported by AuthSMARTBackendServices.
+const (
+	AlgorithmRS384 = "RS384"
+	AlgorithmES384 = "ES384"
+)
+
+// PublisherAuth is how requests to a publisher are authenticated.
+// Secrets are read from the environment or from files, and never stored in the publisher registry.
+type PublisherAuth struct {
+	// The authentication scheme: AuthNone, AuthBearer, AuthAPIKey, or AuthSMARTBackendServices.
+	Type string `json:"type"`
+
+	// The environment variable or file holding the bearer token or API key. Exactly one must be set
+	// for AuthBearer and AuthAPIKey. Surrounding whitespace is trimmed.
+	SecretEnv  string `json:"secret_env,omitempty"`
+	SecretFile string `json:"secret_file,omitempty"`
+
+	// The header the API key is sent in, e.g. "X-API-Key". Required for AuthAPIKey.
+	Header string `json:"header,omitempty"`
+
+	// Additional headers sent with every request, e.g. {"X-Partner": "example"}. Not for secrets.
+	Headers map[string]string `json:"headers,omitempty"`
+
+	// AuthSMARTBackendServices settings.
+	// The client_id registered with the publisher.
+	ClientId string `json:"client_id,omitempty"`
+	// The OAuth token endpoint.
+	TokenUrl string `json:"token_url,omitempty"`
+	// The requested scope. Defaults to "system/*.read".
+	Scope string `json:"scope,omitempty"`
+	// A PEM encoded RSA or P-384 EC private key, as PKCS #8, PKCS #1, or SEC 1.
+	PrivateKeyFile string `json:"private_key_file,omitempty"`
+	// The "kid" of the key in the client's JWK Set. Optional.
+	KeyId string `json:"key_id,omitempty"`
+	// AlgorithmRS384 or AlgorithmES384. Defaults to the algorithm matching the private key.
+	Algorithm string `json:"algorithm,omitempty"`
+}
+
+// Validate checks that the settings required by the auth type are present.
+// Secrets and keys are only read by NewAuthenticator.
+func (a *PublisherAuth) Validate() error {
+	switch a.Type {
+	case AuthNone:
+	case AuthBearer, AuthAPIKey:
+		if (a.SecretEnv == "") == (a.SecretFile == "") {
+			return fmt.Errorf("auth type '%s' requires exactly one of secret_env and secret_file", a.Type)
+		}
+		if a.Type == AuthAPIKey && a.Header == "" {
+			return fmt.Errorf("auth type '%s' requires header", a.Type)
+		}
+	case AuthSMARTBackendServices:
+		if a.ClientId == "" || a.TokenUrl == "" || a.PrivateKeyFile == "" {
+			return fmt.Errorf("auth type '%s' requires client_id, token_url, and private_key_file", a.Type)
+		}
+		switch a.Algorithm {
+		case "", AlgorithmRS384, AlgorithmES384:
+		default:
+			return fmt.Errorf("unknown algorithm '%s': must be '%s' or '%s'", a.Algorithm, AlgorithmRS384, AlgorithmES384)
+		}
+	default:
+		return fmt.Errorf("unknown auth type '%s'", a.Type)
+	}
+	return nil
+}
+
+// Authenticator adds a publisher's credentials to requests.
+// Implementations must be safe to call concurrently.
+type Authenticator interface {
+	Authenticate(ctx context.Context, req *http.Request) error
+}
+
+// CredentialInvalidator is implemented by Authenticators whose credentials may be revoked or rotated
+// before they expire.
+type CredentialInvalidator interface {
+	// Invalidate discards the credentials req was authenticated with, after the publisher rejected
+	// them. Returns false if they can't be replaced with fresh ones.
+	Invalidate(req *http.Request) bool
+}
+
+// publisherAuthenticator sets static headers, and the access token requested by tokens.
+type publisherAuthenticator struct {
+	// Maps header name -> value, including static credentials.
+	headers map[string]string
+
+	// Requests the bearer token. nil unless the auth type is AuthSMARTBackendServices.
+	tokens *SMARTTokenSource
+}
+
+// Authenticate implements Authenticator.
+func (h *publisherAuthenticator) Authenticate(ctx context.Context, req *http.Request) error {
+	for k, v := range h.headers {
+		req.Header.Set(k, v)
+	}
+	if h.tokens != nil {
+		token, err := h.tokens.Token(ctx)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return nil
+}
+
+// Invalidate implements CredentialInvalidator. Only access tokens can be replaced.
+func (h *publisherAuthenticator) Invalidate(req *http.Request) bool {
+	token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if h.tokens == nil || token == "" {
+		return false
+	}
+	h.tokens.Invalidate(token)
+	return true
+}
+
+// credentialHeadersKey is the context key of the credential headers recorded by withCredentialHeaders.
+type credentialHeadersKey struct{}
+
+// withCredentialHeaders returns req with the names of its headers recorded as credentials, so that
+// StripCredentials can remove them from redirects. Must be called after the Authenticator set the
+// request's headers, and before any other headers are set.
+func withCredentialHeaders(req *http.Request) *http.Request {
+	var names []string
+	for name := range req.Header {
+		names = append(names, name)
+	}
+	return req.WithContext(context.WithValue(req.Context(), credentialHeadersKey{}, names))
+}
+
+// StripCredentials removes the credential headers recorded by withCredentialHeaders from req, a
+// redirect of via[0], if req's origin (scheme, host, and port) differs from via[0]'s. http.Client only
+// removes Authorization and Cookie headers, and only if the redirect leaves the domain.
+func StripCredentials(req *http.Request, via []*http.Request) {
+	names, _ := req.Context().Value(credentialHeadersKey{}).([]string)
+	if len(names) == 0 || len(via) == 0 {
+		return
+	}
+	origin, err := OriginOf(via[0].URL.String())
+	if err == nil {
+		var redirectOrigin string
+		if redirectOrigin, err = OriginOf(req.URL.String()); err == nil && redirectOrigin == origin {
+			return
+		}
+	}
+	for _, name := range names {
+		req.Header.Del(name)
+	}
+}
+
+// NewAuthenticator returns the Authenticator for a, reading its secret or private key.
+// client is used to request access tokens.
+func NewAuthenticator(a *PublisherAuth, client *http.Client) (Authenticator, error) {
+	h := &publisherAuthenticator{headers: make(map[string]string)}
+	for k, v := range a.Headers {
+		h.headers[k] = v
+	}
+
+	switch a.Type {
+	case AuthBearer, AuthAPIKey:
+		secret, err := readSecret(a.SecretEnv, a.SecretFile)
+		if err != nil {
+			return nil, err
+		}
+		if a.Type == AuthBearer {
+			h.headers["Authorization"] = "Bearer " + secret
+		} else {
+			h.headers[a.Header] = secret
+		}
+	case AuthSMARTBackendServices:
+		key, err := loadPrivateKey(a.PrivateKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		h.tokens = &SMARTTokenSource{
+			Client:    client,
+			ClientId:  a.ClientId,
+			TokenUrl:  a.TokenUrl,
+			Scope:     a.Scope,
+			Key:       key,
+			KeyId:     a.KeyId,
+			Algorithm: a.Algorithm,
+		}
+		if h.tokens.Scope == "" {
+			h.tokens.Scope = "system/*.read"
+		}
+		if h.tokens.Algorithm == "" {
+			if _, ok := key.(*ecdsa.PrivateKey); ok {
+				h.tokens.Algorithm = AlgorithmES384
+			} else {
+				h.tokens.Algorithm = AlgorithmRS384
+			}
+		}
+		if err := h.tokens.checkKey(); err != nil {
+			return nil, err
+		}
+	}
+	return h, nil
+}
+
+// readSecret returns the trimmed value of the environment variable env, or the contents of file.
+func readSecret(env, file string) (string, error) {
+	if env != "" {
+		v, ok := os.LookupEnv(env)
+		if !ok || strings.TrimSpace(v) == "" {
+			return "", fmt.Errorf("environment variable %s is not set", env)
+		}
+		return strings.TrimSpace(v), nil
+	}
+	c, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(c)), nil
+}
+
+// loadPrivateKey reads a PEM encoded private key from filename.
+func loadPrivateKey(filename string) (crypto.Signer, error) {
+	c, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(c)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM encoded private key in %s", filename)
+	}
+	var key interface{}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("malformed private key in %s: %s", filename, err)
+	}
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return k, nil
+	case *ecdsa.PrivateKey:
+		return k, nil
+	}
+	return nil, fmt.Errorf("unsupported private key type %T in %s: must be RSA or EC", key, filename)
+}
+
+// tokenRefreshMargin is how long before its expiry an access token is refreshed, so that it does
+// not expire while a request is in flight.
+const tokenRefreshMargin = time.Minute
+
+// SMARTTokenSource requests access tokens with SMART Backend Services, and caches them until
+// shortly before they expire, or until they are invalidated.
+// Thread safe.
+type SMARTTokenSource struct {
+	Client    *http.Client
+	ClientId  string
+	TokenUrl  string
+	Scope     string
+	Key       crypto.Signer
+	KeyId     string
+	Algorithm string
+
+	// The cached access token and when it must be refreshed.
+	token   string
+	refresh time.Time
+
+	// Returns the current time. nil uses time.Now. Set by tests to expire tokens.
+	now func() time.Time
+
+	// Guards token and refresh. Held while requesting a token, so that concurrent requests share it.
+	mu sync.Mutex
+}
+
+// checkKey returns an error if Key cannot be used with Algorithm.
+func (s *SMARTTokenSource) checkKey() error {
+	switch k := s.Key.(type) {
+	case *rsa.PrivateKey:
+		if s.Algorithm == AlgorithmRS384 {
+			return nil
+		}
+	case *ecdsa.PrivateKey:
+		if s.Algorithm == AlgorithmES384 && k.Curve == elliptic.P384() {
+			return nil
+		}
+	}
+	return fmt.Errorf("private key %T cannot be used with algorithm %s", s.Key, s.Algorithm)
+}
+
+// Token returns a cached access token, or requests a new one if it is about to expire.
+func (s *SMARTTokenSource) Token(ctx context.Context) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	if s.now != nil {
+		now = s.now()
+	}
+	if s.token != "" && now.Before(s.refresh) {
+		return s.token, nil
+	}
+
+	assertion, err := s.clientAssertion(now)
+	if err != nil {
+		return "", err
+	}
+	form := url.Values{
+		"grant_type":            {"client_credentials"},
+		"scope":                 {s.Scope},
+		"client_assertion_type": {"urn:ietf:params:oauth:client-assertion-type:jwt-bearer"},
+		"client_assertion":      {assertion},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.TokenUrl, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return "", fmt.Errorf("token endpoint %s responded %d: %s", s.TokenUrl, resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+		TokenType   string `json:"token_type"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", fmt.Errorf("malformed response from token endpoint %s: %s", s.TokenUrl, err)
+	}
+	if token.AccessToken == "" || !strings.EqualFold(token.TokenType, "bearer") {
+		return "", fmt.Errorf("token endpoint %s did not return a bearer token", s.TokenUrl)
+	}
+	// Tokens without expires_in are used for a single refresh margin.
+	s.token = token.AccessToken
+	s.refresh = now.Add(time.Duration(token.ExpiresIn)*time.Second - tokenRefreshMargin)
+	if !s.refresh.After(now) {
+		s.refresh = now.Add(tokenRefreshMargin)
+	}
+	return s.token, nil
+}
+
+// Invalidate discards the cached access token if it is token, e.g. because the publisher rejected it,
+// so that the next call to Token requests a new one. Requests rejected concurrently with the same
+// token only cause a single new token to be requested.
+func (s *SMARTTokenSource) Invalidate(token string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.token == token {
+		s.token = ""
+	}
+}
+
+// clientAssertion returns a signed JWT authenticating the client to the token endpoint.
+func (s *SMARTTokenSource) clientAssertion(now time.Time) (string, error) {
+	jti := make([]byte, 16)
+	if _, err := rand.Read(jti); err != nil {
+		return "", err
+	}
+	header := map[string]string{"alg": s.Algorithm, "typ": "JWT"}
+	if s.KeyId != "" {
+		header["kid"] = s.KeyId
+	}
+	claims := map[string]interface{}{
+		"iss": s.ClientId,
+		"sub": s.ClientId,
+		"aud": s.TokenUrl,
+		// The specification allows at most 5 minutes.
+		"exp": now.Add(5 * time.Minute).Unix(),
+		"jti": hex.EncodeToString(jti),
+	}
+	h, err := json.Marshal(header)
+	if err != nil {
+		return "", err
+	}
+	c, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signingInput := base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(c)
+
+	digest := sha512.Sum384([]byte(signingInput))
+	var signature []byte
+	switch k := s.Key.(type) {
+	case *rsa.PrivateKey:
+		if signature, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA384, digest[:]); err != nil {
+			return "", err
+		}
+	case *ecdsa.PrivateKey:
+		r, sig, err := ecdsa.Sign(rand.Reader, k, digest[:])
+		if err != nil {
+			return "", err
+		}
+		// JWS encodes ECDSA signatures as the fixed size concatenation of r and s.
+		signature = append(padInt(r, 48), padInt(sig, 48)...)
+	default:
+		return "", fmt.Errorf("unsupported private key type %T", s.Key)
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// padInt returns the big-endian encoding of n, left padded with zeros to size bytes.
+func padInt(n *big.Int, size int) []byte {
+	b := n.Bytes()
+	return append(make([]byte, size-len(b)), b...)
+}
+
+// OriginOf returns the scheme and host of u, e.g. "https://www.cvs.com".
+func OriginOf(u string) (string, error) {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return "", err
+	}
+	if parsed.Host == "" {
+		return "", fmt.Errorf("URL '%s' has no host", u)
+	}
+	return strings.ToLower(parsed.Scheme) + "://" + strings.ToLower(parsed.Host), nil
+}
@@ -0,0 +1,474 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// headerRecorder is a server which records the headers of the requests it receives.
+type headerRecorder struct {
+	*httptest.Server
+
+	mu      sync.Mutex
+	headers []http.Header
+}
+
+func newHeaderRecorder(handler http.HandlerFunc) *headerRecorder {
+	r := &headerRecorder{}
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		r.mu.Lock()
+		r.headers = append(r.headers, req.Header.Clone())
+		r.mu.Unlock()
+		handler(w, req)
+	}))
+	return r
+}
+
+// lastHeader returns the value of header name in the last request received.
+func (r *headerRecorder) lastHeader(t *testing.T, name string) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.headers) == 0 {
+		t.Fatalf("%s received no requests", r.URL)
+	}
+	return r.headers[len(r.headers)-1].Get(name)
+}
+
+func serveOk(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("ok"))
+}
+
+// fetchWithAuth fetches u with auth set up for the origin of manifestUrl, following redirects.
+func fetchWithAuth(t *testing.T, auth *PublisherAuth, manifestUrl, u string) {
+	client, err := NewHTTPClient(&HTTPClientOptions{
+		Policy: &URLPolicy{AllowPrivateAddresses: true, MaxRedirects: 5},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	registry := &PublisherRegistry{Publishers: []*Publisher{{Name: "test", ManifestUrl: manifestUrl, Auth: auth}}}
+	authenticators, err := registry.Authenticators(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fetcher := &HTTPFetcher{Client: client, Authenticators: authenticators, Stats: &CrawlStats{}}
+	result, err := fetcher.Fetch(context.Background(), u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.ReadAll(result.Body)
+	result.Body.Close()
+}
+
+// writeSecret writes secret into a file and returns its name.
+func writeSecret(t *testing.T, secret string) string {
+	f, err := ioutil.TempFile(t.TempDir(), "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(secret + "\n"); err != nil {
+		t.Fatal(err)
+	}
+	return f.Name()
+}
+
+func TestCredentialsStrippedFromCrossOriginRedirects(t *testing.T) {
+	tests := []struct {
+		name string
+		auth *PublisherAuth
+		// The headers holding the credentials.
+		headers []string
+		// Returns the URL of target as seen from the publisher, e.g. with another host name.
+		redirectUrl func(target string) string
+	}{
+		{
+			name:        "api key to another host",
+			auth:        &PublisherAuth{Type: AuthAPIKey, Header: "X-API-Key", Headers: map[string]string{"X-Partner": "example"}},
+			headers:     []string{"X-API-Key", "X-Partner"},
+			redirectUrl: func(target string) string { return strings.Replace(target, "127.0.0.1", "localhost", 1) },
+		},
+		{
+			name:        "bearer to another port",
+			auth:        &PublisherAuth{Type: AuthBearer},
+			headers:     []string{"Authorization"},
+			redirectUrl: func(target string) string { return target },
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.auth.SecretFile = writeSecret(t, "secret")
+			other := newHeaderRecorder(serveOk)
+			defer other.Close()
+			publisher := newHeaderRecorder(func(w http.ResponseWriter, r *http.Request) {
+				switch r.URL.Path {
+				case "/elsewhere":
+					http.Redirect(w, r, tc.redirectUrl(other.URL)+"/file", http.StatusFound)
+				case "/here":
+					http.Redirect(w, r, "/file", http.StatusFound)
+				default:
+					serveOk(w, r)
+				}
+			})
+			defer publisher.Close()
+			manifestUrl := publisher.URL + "/$bulk-publish"
+
+			fetchWithAuth(t, tc.auth, manifestUrl, publisher.URL+"/here")
+			for _, h := range tc.headers {
+				if publisher.lastHeader(t, h) == "" {
+					t.Errorf("same origin redirect has no %s header", h)
+				}
+			}
+
+			fetchWithAuth(t, tc.auth, manifestUrl, publisher.URL+"/elsewhere")
+			if publisher.lastHeader(t, tc.headers[0]) == "" {
+				t.Errorf("request to the publisher has no %s header", tc.headers[0])
+			}
+			for _, h := range tc.headers {
+				if v := other.lastHeader(t, h); v != "" {
+					t.Errorf("cross origin redirect has %s: %s, want none", h, v)
+				}
+			}
+		})
+	}
+}
+
+// tokenServer is a stand-in SMART Backend Services token endpoint. It verifies every token request and
+// its client assertion, and issues tokens "token-1", "token-2", etc... which expire in expiresIn seconds.
+// Invalid requests are rejected with an OAuth error describing the problem.
+type tokenServer struct {
+	*httptest.Server
+
+	clientId  string
+	publicKey crypto.PublicKey
+	expiresIn int
+
+	// Returns the current time, which client assertions expire relative to.
+	now func() time.Time
+
+	mu sync.Mutex
+	// The number of tokens issued.
+	issued int
+	// The jti claims of the client assertions received.
+	jtis map[string]bool
+}
+
+func newTokenServer(clientId string, publicKey crypto.PublicKey, expiresIn int) *tokenServer {
+	s := &tokenServer{clientId: clientId, publicKey: publicKey, expiresIn: expiresIn, now: time.Now, jtis: make(map[string]bool)}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveToken))
+	return s
+}
+
+func (s *tokenServer) tokenUrl() string {
+	return s.URL + "/oauth2/token"
+}
+
+func (s *tokenServer) tokensIssued() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.issued
+}
+
+func (s *tokenServer) serveToken(w http.ResponseWriter, r *http.Request) {
+	if err := s.verifyRequest(r); err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_client", "error_description": err.Error()})
+		return
+	}
+
+	s.mu.Lock()
+	s.issued++
+	token := fmt.Sprintf("token-%d", s.issued)
+	s.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token": token,
+		"token_type":   "bearer",
+		"expires_in":   s.expiresIn,
+		"scope":        "system/*.read",
+	})
+}
+
+// verifyRequest checks that r is a client credentials token request with a valid client assertion.
+func (s *tokenServer) verifyRequest(r *http.Request) error {
+	if r.Method != http.MethodPost || r.URL.Path != "/oauth2/token" {
+		return fmt.Errorf("%s %s, want POST /oauth2/token", r.Method, r.URL.Path)
+	}
+	if err := r.ParseForm(); err != nil {
+		return err
+	}
+	for k, want := range map[string]string{
+		"grant_type":            "client_credentials",
+		"scope":                 "system/*.read",
+		"client_assertion_type": "urn:ietf:params:oauth:client-assertion-type:jwt-bearer",
+	} {
+		if got := r.PostForm.Get(k); got != want {
+			return fmt.Errorf("%s is %q, want %q", k, got, want)
+		}
+	}
+	return s.verifyAssertion(r.PostForm.Get("client_assertion"))
+}
+
+// verifyAssertion checks the signature and claims of a client assertion JWT.
+func (s *tokenServer) verifyAssertion(assertion string) error {
+	parts := strings.Split(assertion, ".")
+	if len(parts) != 3 {
+		return fmt.Errorf("%d parts, want 3", len(parts))
+	}
+	var header map[string]string
+	var claims map[string]interface{}
+	for i, v := range []interface{}{&header, &claims} {
+		b, err := base64.RawURLEncoding.DecodeString(parts[i])
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(b, v); err != nil {
+			return err
+		}
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return err
+	}
+	digest := sha512.Sum384([]byte(parts[0] + "." + parts[1]))
+	switch k := s.publicKey.(type) {
+	case *rsa.PublicKey:
+		if header["alg"] != AlgorithmRS384 {
+			return fmt.Errorf("alg %s, want %s", header["alg"], AlgorithmRS384)
+		}
+		if err := rsa.VerifyPKCS1v15(k, crypto.SHA384, digest[:], signature); err != nil {
+			return err
+		}
+	case *ecdsa.PublicKey:
+		if header["alg"] != AlgorithmES384 {
+			return fmt.Errorf("alg %s, want %s", header["alg"], AlgorithmES384)
+		}
+		if len(signature) != 96 {
+			return fmt.Errorf("signature is %d bytes, want 96", len(signature))
+		}
+		r, sig := new(big.Int).SetBytes(signature[:48]), new(big.Int).SetBytes(signature[48:])
+		if !ecdsa.Verify(k, digest[:], r, sig) {
+			return fmt.Errorf("bad signature")
+		}
+	}
+	if header["typ"] != "JWT" || header["kid"] != "key-1" {
+		return fmt.Errorf("header %v, want typ JWT and kid key-1", header)
+	}
+
+	if claims["iss"] != s.clientId || claims["sub"] != s.clientId || claims["aud"] != s.tokenUrl() {
+		return fmt.Errorf("claims %v, want iss and sub %s, and aud %s", claims, s.clientId, s.tokenUrl())
+	}
+	exp, _ := claims["exp"].(float64)
+	if ttl := time.Unix(int64(exp), 0).Sub(s.now()); ttl <= 0 || ttl > 5*time.Minute {
+		return fmt.Errorf("exp is %s from now, want at most 5 minutes", ttl)
+	}
+	jti, _ := claims["jti"].(string)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if jti == "" || s.jtis[jti] {
+		return fmt.Errorf("jti %q is empty or reused", jti)
+	}
+	s.jtis[jti] = true
+	return nil
+}
+
+// writePrivateKey writes key into a PKCS #8 PEM file and returns its name.
+func writePrivateKey(t *testing.T, key crypto.Signer) string {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	filename := filepath.Join(t.TempDir(), "key.pem")
+	if err := ioutil.WriteFile(filename, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+// authorization returns the Authorization header a sets.
+func authorization(t *testing.T, a Authenticator) string {
+	req := httptest.NewRequest(http.MethodGet, "https://publisher.example/$bulk-publish", nil)
+	if err := a.Authenticate(context.Background(), req); err != nil {
+		t.Fatalf("Authenticate() failed: %s", err)
+	}
+	return req.Header.Get("Authorization")
+}
+
+func TestSMARTBackendServices(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name string
+		key  crypto.Signer
+	}{
+		{name: AlgorithmRS384, key: rsaKey},
+		{name: AlgorithmES384, key: ecKey},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			const expiresIn = 300
+			s := newTokenServer("aggregator", tc.key.Public(), expiresIn)
+			defer s.Close()
+			a, err := NewAuthenticator(&PublisherAuth{
+				Type:           AuthSMARTBackendServices,
+				ClientId:       "aggregator",
+				TokenUrl:       s.tokenUrl(),
+				PrivateKeyFile: writePrivateKey(t, tc.key),
+				KeyId:          "key-1",
+			}, s.Client())
+			if err != nil {
+				t.Fatal(err)
+			}
+			tokens := a.(*publisherAuthenticator).tokens
+			now := time.Now()
+			tokens.now = func() time.Time { return now }
+			s.now = tokens.now
+
+			if got := authorization(t, a); got != "Bearer token-1" {
+				t.Errorf("Authorization = %q, want %q", got, "Bearer token-1")
+			}
+
+			// Cached until tokenRefreshMargin before it expires.
+			now = now.Add(expiresIn*time.Second - tokenRefreshMargin - time.Second)
+			if got := authorization(t, a); got != "Bearer token-1" {
+				t.Errorf("Authorization of cached token = %q, want %q", got, "Bearer token-1")
+			}
+			if n := s.tokensIssued(); n != 1 {
+				t.Errorf("%d tokens issued, want 1", n)
+			}
+
+			now = now.Add(2 * time.Second)
+			if got := authorization(t, a); got != "Bearer token-2" {
+				t.Errorf("Authorization of refreshed token = %q, want %q", got, "Bearer token-2")
+			}
+			if n := s.tokensIssued(); n != 2 {
+				t.Errorf("%d tokens issued, want 2", n)
+			}
+		})
+	}
+}
+
+func TestSMARTBackendServicesTokenError(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The server expects another key, so it rejects the client assertion.
+	other, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newTokenServer("aggregator", other.Public(), 300)
+	defer s.Close()
+	a, err := NewAuthenticator(&PublisherAuth{
+		Type:           AuthSMARTBackendServices,
+		ClientId:       "aggregator",
+		TokenUrl:       s.tokenUrl(),
+		PrivateKeyFile: writePrivateKey(t, key),
+		KeyId:          "key-1",
+	}, s.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodGet, "https://publisher.example/$bulk-publish", nil)
+	if err := a.Authenticate(context.Background(), req); err == nil || !strings.Contains(err.Error(), "responded 401") {
+		t.Errorf("Authenticate() = %v, want an error about the 401 response", err)
+	}
+}
+
+func TestSMARTBackendServicesRevokedToken(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name string
+		// The access token the publisher accepts.
+		accepted string
+		// The expected status of the fetch.
+		status int
+	}{
+		// token-1 was revoked, so it is replaced by token-2.
+		{name: "revoked", accepted: "token-2", status: http.StatusOK},
+		// The request is only sent again once.
+		{name: "rejected", accepted: "token-3", status: http.StatusUnauthorized},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newTokenServer("aggregator", key.Public(), 300)
+			defer s.Close()
+			publisher := newHeaderRecorder(func(w http.ResponseWriter, r *http.Request) {
+				if r.Header.Get("Authorization") != "Bearer "+tc.accepted {
+					w.WriteHeader(http.StatusUnauthorized)
+					return
+				}
+				serveOk(w, r)
+			})
+			defer publisher.Close()
+			a, err := NewAuthenticator(&PublisherAuth{
+				Type:           AuthSMARTBackendServices,
+				ClientId:       "aggregator",
+				TokenUrl:       s.tokenUrl(),
+				PrivateKeyFile: writePrivateKey(t, key),
+				KeyId:          "key-1",
+			}, s.Client())
+			if err != nil {
+				t.Fatal(err)
+			}
+			origin, err := OriginOf(publisher.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			fetcher := &HTTPFetcher{Client: publisher.Client(), Authenticators: map[string]Authenticator{origin: a}, Stats: &CrawlStats{}}
+			result, err := fetcher.Fetch(context.Background(), publisher.URL)
+			status := http.StatusOK
+			var statusErr *HTTPStatusError
+			if errors.As(err, &statusErr) {
+				status = statusErr.StatusCode
+			} else if err != nil {
+				t.Fatal(err)
+			} else {
+				result.Body.Close()
+			}
+			if status != tc.status {
+				t.Errorf("Fetch() status = %d, want %d", status, tc.status)
+			}
+			publisher.mu.Lock()
+			requests := len(publisher.headers)
+			publisher.mu.Unlock()
+			if requests != 2 {
+				t.Errorf("publisher received %d requests, want 2", requests)
+			}
+			if n := s.tokensIssued(); n != 2 {
+				t.Errorf("%d tokens issued, want 2", n)
+			}
+		})
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CacheEntry is the metadata of a cached HTTP response.
+type CacheEntry struct {
+	// The requested URL.
+	Url string `json:"url"`
+
+	// The URL the response was served from, after following redirects.
+	FinalUrl string `json:"final_url"`
+
+	// The response's Content-Type. May be empty.
+	ContentType string `json:"content_type"`
+
+	// Validators used for conditional requests. May be empty.
+	ETag         string `json:"etag"`
+	LastModified string `json:"last_modified"`
+
+	// The time after which the entry must be revalidated with the server.
+	Expires time.Time `json:"expires"`
+}
+
+// Fresh returns whether the entry can be used without revalidating with the server.
+func (e *CacheEntry) Fresh(now time.Time) bool {
+	return now.Before(e.Expires)
+}
+
+// result returns a FetchResult serving body from the cache.
+func (e *CacheEntry) result(body io.ReadCloser, cacheResult string, start time.Time) *FetchResult {
+	finalUrl := e.FinalUrl
+	if finalUrl == "" {
+		finalUrl = e.Url
+	}
+	return timeBody(&FetchResult{
+		Body:         body,
+		StatusCode:   http.StatusOK,
+		FinalUrl:     finalUrl,
+		ContentType:  e.ContentType,
+		ETag:         e.ETag,
+		LastModified: e.LastModified,
+		CacheResult:  cacheResult,
+		StartTime:    start,
+	})
+}
+
+// DiskCache is an on-disk cache of HTTP response bodies keyed by URL.
+// Entries are written atomically, so a DiskCache is safe to use from multiple goroutines.
+type DiskCache struct {
+	// Directory the cache files are written to. Created if it doesn't exist.
+	Dir string
+}
+
+// path returns the cache file path for u with the given suffix.
+func (d *DiskCache) path(u, suffix string) string {
+	h := sha256.Sum256([]byte(u))
+	return filepath.Join(d.Dir, hex.EncodeToString(h[:])+suffix)
+}
+
+// Load returns the cache entry for u.
+// Returns nil if u is not cached or the cache files cannot be read.
+func (d *DiskCache) Load(u string) *CacheEntry {
+	meta, err := ioutil.ReadFile(d.path(u, ".json"))
+	if err != nil {
+		return nil
+	}
+	var entry CacheEntry
+	if err := json.Unmarshal(meta, &entry); err != nil || entry.Url != u {
+		return nil
+	}
+	if _, err := os.Stat(d.path(u, ".body")); err != nil {
+		return nil
+	}
+	return &entry
+}
+
+// OpenBody opens the cached response body of u for reading.
+func (d *DiskCache) OpenBody(u string) (*os.File, error) {
+	return os.Open(d.path(u, ".body"))
+}
+
+// Store writes entry into the cache.
+func (d *DiskCache) Store(entry *CacheEntry) error {
+	meta, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return d.writeFileAtomic(d.path(entry.Url, ".json"), bytes.NewReader(meta))
+}
+
+// StoreBody streams the response body of u from body into the cache.
+func (d *DiskCache) StoreBody(u string, body io.Reader) error {
+	return d.writeFileAtomic(d.path(u, ".body"), body)
+}
+
+// writeFileAtomic writes contents into a temporary file and renames it to filename, so that
+// concurrent readers never observe a partially written file.
+func (d *DiskCache) writeFileAtomic(filename string, contents io.Reader) error {
+	if err := os.MkdirAll(d.Dir, 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(d.Dir, filepath.Base(filename)+".tmp*")
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(tmp, contents); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), filename)
+}
+
+// CacheableResponse returns whether resp may be stored in the cache.
+func CacheableResponse(resp *http.Response) bool {
+	if resp.StatusCode != http.StatusOK {
+		return false
+	}
+	_, noStore := cacheControlDirectives(resp.Header)["no-store"]
+	return !noStore
+}
+
+// ExpiresAt computes when a response with header h, received at now, must be revalidated.
+// Cache-Control max-age takes precedence over Expires. Responses without explicit freshness
+// information are revalidated on every request.
+func ExpiresAt(h http.Header, now time.Time) time.Time {
+	directives := cacheControlDirectives(h)
+	if _, ok := directives["no-cache"]; ok {
+		return now
+	}
+	if v, ok := directives["max-age"]; ok {
+		maxAge, err := strconv.Atoi(v)
+		if err != nil {
+			return now
+		}
+		age, _ := strconv.Atoi(h.Get("Age"))
+		return now.Add(time.Duration(maxAge-age) * time.Second)
+	}
+	if v := h.Get("Expires"); v != "" {
+		// Malformed Expires values, e.g. "0", mean already expired.
+		expires, err := http.ParseTime(v)
+		if err != nil {
+			return now
+		}
+		return expires
+	}
+	return now
+}
+
+// cacheControlDirectives parses the Cache-Control header into a map of lower case directive -> value.
+func cacheControlDirectives(h http.Header) map[string]string {
+	directives := make(map[string]string)
+	for _, d := range strings.Split(h.Get("Cache-Control"), ",") {
+		d = strings.TrimSpace(d)
+		if d == "" {
+			continue
+		}
+		parts := strings.SplitN(d, "=", 2)
+		key := strings.ToLower(parts[0])
+		if len(parts) == 2 {
+			directives[key] = strings.Trim(parts[1], `"`)
+		} else {
+			directives[key] = ""
+		}
+	}
+	return directives
+}
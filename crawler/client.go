@@ -0,0 +1,311 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// HTTPClientOptions configure the client used to fetch files and access tokens.
+type HTTPClientOptions struct {
+	// The timeout for establishing connections, including TLS handshakes. 0 disables the timeout.
+	ConnectTimeout time.Duration
+
+	// The timeout for receiving response headers after sending a request. 0 disables the timeout.
+	// HTTPFetcher.ReadTimeout applies the same timeout to reads of the response body.
+	ReadTimeout time.Duration
+
+	// The timeout for a whole request, including reading the response body. 0 disables the timeout.
+	Timeout time.Duration
+
+	// The User-Agent header sent with every request. Empty uses Go's default.
+	UserAgent string
+
+	// The URL of the HTTP proxy requests are sent through. Empty uses the HTTP_PROXY, HTTPS_PROXY,
+	// and NO_PROXY environment variables.
+	Proxy string
+
+	// A file of PEM encoded CA certificates trusted in addition to the system's. May be empty.
+	CABundle string
+
+	// Restricts the addresses connected to and the redirects followed. nil allows everything, except
+	// that publisher credentials are always removed from redirects to other origins.
+	// If requests are sent through a proxy, the proxy's address is allowed and Policy.ResolveHosts is set.
+	Policy *URLPolicy
+}
+
+// NewHTTPClient returns a client configured with opts.
+func NewHTTPClient(opts *HTTPClientOptions) (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	dialer := &net.Dialer{Timeout: opts.ConnectTimeout, KeepAlive: 30 * time.Second}
+	transport.DialContext = dialer.DialContext
+	transport.TLSHandshakeTimeout = opts.ConnectTimeout
+	transport.ResponseHeaderTimeout = opts.ReadTimeout
+
+	if opts.Proxy != "" {
+		proxy, err := url.Parse(opts.Proxy)
+		if err != nil || proxy.Host == "" {
+			return nil, fmt.Errorf("malformed proxy URL '%s'", opts.Proxy)
+		}
+		transport.Proxy = http.ProxyURL(proxy)
+	}
+
+	if opts.Policy != nil {
+		exempt, err := proxyAddresses(transport.Proxy)
+		if err != nil {
+			return nil, err
+		}
+		opts.Policy.ResolveHosts = len(exempt) > 0
+		dialer.Control = opts.Policy.DialControl(exempt)
+	}
+
+	if opts.CABundle != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		pem, err := ioutil.ReadFile(opts.CABundle)
+		if err != nil {
+			return nil, err
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no PEM encoded certificates in CA bundle %s", opts.CABundle)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+
+	var rt http.RoundTripper = transport
+	if opts.UserAgent != "" {
+		rt = &userAgentTransport{userAgent: opts.UserAgent, next: transport}
+	}
+	client := &http.Client{Transport: rt, Timeout: opts.Timeout}
+	if opts.Policy != nil {
+		client.CheckRedirect = opts.Policy.CheckRedirect
+	} else {
+		client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+			StripCredentials(req, via)
+			// http.Client's default policy.
+			if len(via) >= 10 {
+				return errors.New("stopped after 10 redirects")
+			}
+			return nil
+		}
+	}
+	return client, nil
+}
+
+// proxyAddresses returns the resolved "ip:port" addresses of the proxies proxy sends http and https
+// requests through, or an empty map if requests are not proxied.
+func proxyAddresses(proxy func(*http.Request) (*url.URL, error)) (map[string]bool, error) {
+	addresses := make(map[string]bool)
+	if proxy == nil {
+		return addresses, nil
+	}
+	for _, u := range []string{"http://example.com", "https://example.com"} {
+		req, _ := http.NewRequest(http.MethodGet, u, nil)
+		proxyUrl, err := proxy(req)
+		if err != nil {
+			return nil, err
+		}
+		if proxyUrl == nil {
+			continue
+		}
+		port := proxyUrl.Port()
+		if port == "" {
+			switch proxyUrl.Scheme {
+			case "https":
+				port = "443"
+			case "socks5":
+				port = "1080"
+			default:
+				port = "80"
+			}
+		}
+		ips, err := net.LookupIP(proxyUrl.Hostname())
+		if err != nil {
+			return nil, fmt.Errorf("cannot resolve proxy %s: %s", proxyUrl.Host, err)
+		}
+		for _, ip := range ips {
+			addresses[net.JoinHostPort(ip.String(), port)] = true
+		}
+	}
+	return addresses, nil
+}
+
+// userAgentTransport sets the User-Agent header of requests.
+type userAgentTransport struct {
+	userAgent string
+	next      http.RoundTripper
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *userAgentTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// RoundTrippers must not modify the request.
+	req = req.Clone(req.Context())
+	req.Header.Set("User-Agent", t.userAgent)
+	return t.next.RoundTrip(req)
+}
+
+// ParseByteSize parses a size in bytes with an optional KiB, MiB, or GiB suffix, e.g. "16MiB".
+func ParseByteSize(s string) (int64, error) {
+	multiplier := int64(1)
+	for suffix, m := range map[string]int64{"KiB": 1 << 10, "MiB": 1 << 20, "GiB": 1 << 30} {
+		if strings.HasSuffix(s, suffix) {
+			s = strings.TrimSuffix(s, suffix)
+			multiplier = m
+			break
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return n * multiplier, nil
+}
+
+// ParseMaxResponseBytes parses comma separated per file type response size limits, e.g.
+// "manifest=16MiB,slot=1GiB". File types are lower case: "manifest", "location", "schedule", or "slot".
+// Returns a map of file type -> limit in bytes.
+func ParseMaxResponseBytes(s string) (map[string]int64, error) {
+	limits := make(map[string]int64)
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("malformed response size limit '%s': expected TYPE=SIZE", entry)
+		}
+		fileType := strings.ToLower(parts[0])
+		switch fileType {
+		case "manifest", "location", "schedule", "slot":
+		default:
+			return nil, fmt.Errorf("unknown file type '%s' in response size limit '%s'", parts[0], entry)
+		}
+		n, err := ParseByteSize(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("malformed size in response size limit '%s': %s", entry, err)
+		}
+		limits[fileType] = n
+	}
+	return limits, nil
+}
+
+// ResponseTooLargeError is returned when a response is larger than the limit set by WithMaxResponseBytes.
+type ResponseTooLargeError struct {
+	Url      string
+	MaxBytes int64
+}
+
+func (e *ResponseTooLargeError) Error() string {
+	return fmt.Sprintf("response from %s is larger than %d bytes", e.Url, e.MaxBytes)
+}
+
+// maxResponseBytesKey is the context key of the limit set by WithMaxResponseBytes.
+type maxResponseBytesKey struct{}
+
+// WithMaxResponseBytes returns a context limiting the size of responses fetched with it to n bytes.
+// Values of n <= 0 disable the limit.
+func WithMaxResponseBytes(ctx context.Context, n int64) context.Context {
+	return context.WithValue(ctx, maxResponseBytesKey{}, n)
+}
+
+// responseByteLimit returns the limit set by WithMaxResponseBytes, or 0 if there is none.
+func responseByteLimit(ctx context.Context) int64 {
+	n, _ := ctx.Value(maxResponseBytesKey{}).(int64)
+	return n
+}
+
+// limitedBody is a response body which fails once more than maxBytes are read.
+type limitedBody struct {
+	io.ReadCloser
+	url      string
+	maxBytes int64
+	read     int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.read += int64(n)
+	if b.read > b.maxBytes {
+		return n, &ResponseTooLargeError{Url: b.url, MaxBytes: b.maxBytes}
+	}
+	return n, err
+}
+
+// ReadTimeoutError is returned when no data is received from a response body for the read timeout.
+type ReadTimeoutError struct {
+	Url   string
+	After time.Duration
+}
+
+func (e *ReadTimeoutError) Error() string {
+	return fmt.Sprintf("no data received from %s for %s", e.Url, e.After)
+}
+
+// Timeout and Temporary implement net.Error, so that read timeouts are classified and retried like
+// other timeouts.
+func (e *ReadTimeoutError) Timeout() bool   { return true }
+func (e *ReadTimeoutError) Temporary() bool { return true }
+
+// timeoutBody is a response body whose request is cancelled if a single Read blocks for longer than
+// timeout. Closing the body cancels the request.
+type timeoutBody struct {
+	body    io.ReadCloser
+	url     string
+	timeout time.Duration
+	cancel  context.CancelFunc
+
+	// Cancels the request once a Read blocks for timeout. nil if timeout is 0.
+	timer *time.Timer
+	// Set to 1 when the timer fired.
+	timedOut int32
+}
+
+// newTimeoutBody returns body with a read timeout. cancel must cancel body's request.
+func newTimeoutBody(body io.ReadCloser, u string, timeout time.Duration, cancel context.CancelFunc) *timeoutBody {
+	b := &timeoutBody{body: body, url: u, timeout: timeout, cancel: cancel}
+	if timeout > 0 {
+		b.timer = time.AfterFunc(timeout, func() {
+			atomic.StoreInt32(&b.timedOut, 1)
+			cancel()
+		})
+		b.timer.Stop()
+	}
+	return b
+}
+
+func (b *timeoutBody) Read(p []byte) (int, error) {
+	if b.timer == nil {
+		return b.body.Read(p)
+	}
+	// Only time spent waiting for the server counts, not time spent by the caller between reads.
+	b.timer.Reset(b.timeout)
+	n, err := b.body.Read(p)
+	b.timer.Stop()
+	if err != nil && err != io.EOF && atomic.LoadInt32(&b.timedOut) == 1 {
+		err = &ReadTimeoutError{Url: b.url, After: b.timeout}
+	}
+	return n, err
+}
+
+func (b *timeoutBody) Close() error {
+	if b.timer != nil {
+		b.timer.Stop()
+	}
+	err := b.body.Close()
+	b.cancel()
+	return err
+}
@@ -1,26 +1,74 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
 	"flag"
 	"fmt"
-	"io"
 	"io/ioutil"
 	"log"
-	"net/http"
-	"net/url"
+	"math/rand"
 	"os"
+	"os/signal"
+	"sort"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
+	"github.com/lazau/scheduling-links-aggregator/internal/publish"
 	_ "github.com/mattn/go-sqlite3"
 )
 
 var (
-	manifestUrls = flag.String("manifest_urls", "manifest_urls", "A file containing a list of manifest URLs on each line.")
-	output       = flag.String("output", "/tmp/crawler_output.VERSION.sqlite", "The output file. 'VERSION' is replaced by the current unix epoch timestamp.")
+	publishers   = flag.String("publishers", "", "A JSON file listing the publishers to crawl, and their settings. See PublisherRegistry in crawler/publishers.go.")
+	manifestUrls = flag.String("manifest_urls", "manifest_urls", "A file containing a list of manifest URLs on each line. Ignored if --publishers is set.")
+	output       = flag.String("output", "/tmp/crawler_output.VERSION.sqlite", "The output file. 'VERSION' is replaced by the current unix epoch timestamp. The output is written into the file suffixed with '.partial', and renamed to the output file once complete.")
+	concurrency  = flag.Int("concurrency", 8, "The maximum number of files fetched concurrently across all manifests.")
+	fanOut       = flag.Int("manifest_fan_out", 4, "The maximum number of leaf files fetched concurrently for a single manifest.")
+
+	hostMaxQPS      = flag.Float64("host_max_qps", 2, "The maximum number of requests per second issued to a single host. <= 0 disables rate limiting.")
+	hostMaxInFlight = flag.Int("host_max_in_flight", 2, "The maximum number of in-flight requests to a single host. <= 0 disables the cap.")
+	hostOverrides   = flag.String("host_overrides", "", "Comma separated per-host limits overriding --host_max_qps and --host_max_in_flight, e.g. 'www.cvs.com=0.5:1'. Format: HOST=QPS:MAX_IN_FLIGHT.")
+
+	maxAttempts   = flag.Int("max_attempts", 4, "The maximum number of attempts made to fetch a single file.")
+	retryBudget   = flag.Int("retry_budget", 500, "The maximum number of retries made across the whole crawl.")
+	retryBaseWait = flag.Duration("retry_base_delay", time.Second, "The backoff before the first retry of a file. Doubled for every subsequent retry.")
+	retryMaxWait  = flag.Duration("retry_max_delay", time.Minute, "The maximum backoff between retries, including delays requested by Retry-After.")
+
+	incremental    = flag.Bool("incremental", false, "Crawl incrementally: request manifests with _since set to the transactionTime of the previous crawl, and merge the results with the previous crawl's output.")
+	previousOutput = flag.String("previous_output", "", "The previous crawler output used by --incremental. If empty, finds the latest file matching --output.")
+
+	database   = flag.String("database", "", "A long-lived crawler database to append this crawl to, created if it doesn't exist. If set, --output is ignored, and --incremental uses the database's latest crawl.")
+	retainRuns = flag.Int("retain_runs", 0, "The number of latest crawl runs kept in --database. Older runs and their files are deleted. 0 keeps all runs.")
+
+	storage      = flag.String("storage", StorageContents, "How Location, Schedule, and Slot files are stored: 'contents' stores each file in its table's contents column, 'lines' streams each line into a row of the file's lines table, e.g. slot_lines, and 'blob' stores each distinct file once, compressed, in the blobs table. The parser parses identical files once per manifest in any mode. Use 'lines' for publishers with very large files, and 'blob' with --database.")
+	compression  = flag.String("compression", CompressionZstd, "The compression used by --storage=blob: 'none', 'gzip', or 'zstd'.")
+	maxLineBytes = flag.Int("max_line_bytes", 16*1024*1024, "The maximum length of a single line of a file stored with --storage=lines.")
+
+	connectTimeout   = flag.Duration("connect_timeout", 30*time.Second, "The timeout for connecting to a publisher, including the TLS handshake. 0 disables the timeout.")
+	readTimeout      = flag.Duration("read_timeout", time.Minute, "The timeout for receiving response headers, and for each read of a response body. 0 disables the timeout.")
+	fetchTimeout     = flag.Duration("fetch_timeout", 30*time.Minute, "The timeout for a single fetch, including reading the whole response body. 0 disables the timeout.")
+	userAgent        = flag.String("user_agent", "scheduling-links-aggregator (+https://github.com/lazau/scheduling-links-aggregator)", "The User-Agent sent to publishers. Please include contact info, e.g. an email address, so publishers can reach you.")
+	proxy            = flag.String("proxy", "", "The URL of an HTTP proxy, e.g. a caching proxy, to send all requests through. If empty, uses the HTTP_PROXY and HTTPS_PROXY environment variables.")
+	caBundle         = flag.String("ca_bundle", "", "A file of PEM encoded CA certificates to trust in addition to the system's.")
+	maxResponseBytes = flag.String("max_response_bytes", "manifest=16MiB,location=1GiB,schedule=1GiB,slot=4GiB", "Comma separated per file type response size limits. Larger files fail to crawl. Format: TYPE=SIZE, where SIZE is in bytes or has a KiB, MiB, or GiB suffix.")
+
+	allowPrivateAddresses = flag.Bool("allow_private_addresses", false, "Allow fetching URLs which point at private, loopback, or link-local addresses. By default these are rejected, so that manifests cannot direct the crawler at internal services.")
+	maxRedirects          = flag.Int("max_redirects", 5, "The maximum number of redirects followed per request.")
+	sameOriginLeafFiles   = flag.Bool("same_origin_leaf_files", false, "Reject leaf files whose URLs do not share the origin (scheme, host, and port) of their manifest.")
+
+	crawlInvalidManifests = flag.Bool("crawl_invalid_manifests", false, "Crawl the Location, Schedule, and Slot files of manifests which fail validation. Invalid manifests are recorded in the manifest_validation_errors table either way.")
+
+	recordFixtures = flag.String("record_fixtures", "", "A directory to record the result of every fetch into, for --replay_fixtures.")
+	replayFixtures = flag.String("replay_fixtures", "", "A directory of fetches recorded with --record_fixtures to serve the crawl from, without network access. URLs which were not recorded fail.")
+
+	cacheDir = flag.String("cache_dir", "/tmp/crawler_cache", "The directory used to cache fetched files between crawls. Empty disables caching.")
+
+	resume = flag.Bool("resume", false, "Resume the latest crawl run if it did not complete, e.g. because the crawler was interrupted, instead of starting a new crawl: in --database if set, otherwise in the latest unpublished file matching --output. Pass the same flags as the interrupted crawl.")
+
+	latest = flag.String("latest", "/tmp/crawler_output.latest", "A symlink updated to point at the output file once it is complete and published. Empty disables. Ignored with --database.")
 )
 
 // OutputSchema is the schema for the sqlite database written into the output file.
@@ -28,23 +76,145 @@ var OutputSchema = `
 PRAGMA encoding = "UTF-8";
 PRAGMA foreign_keys = ON;
 
+-- Crawler invocations. An output file created with --output contains a single crawl run, while
+-- a --database accumulates crawl runs over time.
+CREATE TABLE crawl_runs(
+    crawl_run_id INTEGER PRIMARY KEY,
+
+    -- When the crawl started/ended, as milliseconds since Unix epoch.
+    -- end_ms is NULL while the crawl is running, or if the crawler was killed.
+    start_ms INTEGER NOT NULL,
+    end_ms INTEGER,
+
+    -- "running" while the crawl is running, "complete" once every manifest was crawled, or
+    -- "interrupted" if the crawler was stopped by SIGINT or SIGTERM. Crawls whose crawler was
+    -- killed remain "running". Crawl runs which are not complete can be finished with --resume.
+    status TEXT NOT NULL,
+
+    -- The crawler's flags, as a JSON object of flag name -> value.
+    config TEXT NOT NULL,
+
+    -- The number of files crawled and the number of files which failed. NULL until the crawl ends.
+    -- Resumed crawl runs only count the files crawled by the last crawler invocation.
+    files_crawled INTEGER,
+    files_failed INTEGER,
+
+    -- The crawl stats summary. NULL until the crawl ends.
+    stats TEXT
+);
+
+-- Slot Publishers, as configured in --publishers when the crawl ran.
+CREATE TABLE publishers(
+    publisher_id INTEGER PRIMARY KEY,
+
+    -- The crawl run the publisher was configured for.
+    crawl_run_id NOT NULL
+      REFERENCES crawl_runs(crawl_run_id)
+        ON DELETE CASCADE,
+
+    -- The publisher's unique name. The manifest URL if the crawler was run with --manifest_urls.
+    name TEXT NOT NULL,
+
+    -- The URL of the publisher's manifest file.
+    manifest_url TEXT NOT NULL,
+
+    -- 1 if the publisher was crawled, 0 if it was disabled.
+    enabled INTEGER NOT NULL,
+
+    -- The publisher's entry in --publishers as a JSON object, including its rate limits, auth,
+    -- expected states, and contact info. See Publisher in crawler/publishers.go.
+    config TEXT NOT NULL
+);
+
 -- Manifest files.
 CREATE TABLE manifests(
     manifest_id INTEGER PRIMARY KEY,
 
+    -- The crawl run this file was crawled by.
+    crawl_run_id NOT NULL
+      REFERENCES crawl_runs(crawl_run_id)
+        ON DELETE CASCADE,
+
+    -- The publisher this manifest belongs to.
+    publisher_id NOT NULL
+      REFERENCES publishers(publisher_id)
+        ON DELETE CASCADE,
+
     -- The URL of the manifest file.
     url TEXT NOT NULL,
 
     -- The manifest file's contents.
     -- See https://github.com/smart-on-fhir/smart-scheduling-links/blob/master/specification.md#manifest-file
     -- for file content definition.
-    contents TEXT NOT NULL
+    contents TEXT NOT NULL,
+
+    -- Always "contents". See the locations table.
+    storage TEXT NOT NULL,
+
+    -- The hex encoded SHA-256 of the file's contents.
+    sha256 TEXT NOT NULL,
+
+    -- The manifest's transactionTime. NULL if the manifest could not be parsed.
+    transaction_time TEXT,
+
+    -- The _since parameter the manifest was requested with. NULL if the manifest was fetched in full.
+    -- The leaf files of a manifest requested with _since include copies of the previous crawl's
+    -- files, whose fetch_start_ms is before the manifest's. Files fetched with _since only hold
+    -- the resources which changed, and take precedence over the copies, even those with the same URL.
+    since TEXT,
+
+    -- Whether the manifest passed validation. See the manifest_validation_errors table for
+    -- the problems with invalid manifests, whose leaf files are not crawled unless
+    -- --crawl_invalid_manifests is set.
+    valid BOOLEAN NOT NULL,
+
+    -- When the manifest and all of its leaf files were crawled, as milliseconds since Unix epoch.
+    -- NULL if the crawl was interrupted first, in which case --resume crawls the remaining leaf files.
+    crawl_end_ms INTEGER,
+
+    -- Fetch metadata.
+    -- The HTTP status code of the response.
+    http_status INTEGER NOT NULL,
+    -- The URL the file was served from, after following redirects.
+    final_url TEXT NOT NULL,
+    -- The Content-Type, ETag, and Last-Modified response headers. NULL if absent.
+    content_type TEXT,
+    etag TEXT,
+    last_modified TEXT,
+    -- The size of the file in bytes.
+    size_bytes INTEGER NOT NULL,
+    -- When the fetch started, as milliseconds since Unix epoch.
+    fetch_start_ms INTEGER NOT NULL,
+    -- How long the fetch took in milliseconds, from sending the request until the response body was
+    -- fully read. Files served from the crawler's cache are timed until the cached body was read.
+    fetch_duration_ms INTEGER NOT NULL,
+    -- "fresh" if served from the crawler's cache, "not modified" if revalidated with the
+    -- publisher, "miss" if downloaded. NULL if the cache is disabled.
+    cache_result TEXT
+);
+
+-- Problems found by validating manifest files. See ValidateManifest in crawler/validate.go.
+CREATE TABLE manifest_validation_errors(
+    manifest_id NOT NULL
+      REFERENCES manifests(manifest_id)
+        ON DELETE CASCADE,
+
+    -- The jq style path of the offending field, e.g. '.["output"][0]["type"]'. '.' for the whole file.
+    field TEXT NOT NULL,
+
+    -- What is wrong with the field.
+    message TEXT NOT NULL
 );
 
 -- Location files.
 CREATE TABLE locations(
     location_id INTEGER PRIMARY KEY,
 
+    -- The crawl run this file was crawled by.
+    crawl_run_id NOT NULL
+      REFERENCES crawl_runs(crawl_run_id)
+        ON DELETE CASCADE,
+
     -- The URL of the location file.
     url TEXT NOT NULL,
 
@@ -56,13 +226,39 @@ CREATE TABLE locations(
     -- The location file's contents.
     -- See https://github.com/smart-on-fhir/smart-scheduling-links/blob/master/specification.md#location-file
     -- for file content definition.
-    contents TEXT NOT NULL
+    -- NULL unless storage is "contents".
+    contents TEXT,
+
+    -- How the file's contents are stored. See --storage.
+    -- "contents": in the contents column.
+    -- "lines": in location_lines.
+    -- "blob": in the blobs row whose sha256 matches this file's sha256.
+    storage TEXT NOT NULL,
+
+    -- The hex encoded SHA-256 of the file's contents.
+    sha256 TEXT NOT NULL,
+
+    -- Fetch metadata. See the manifests table for column definitions.
+    http_status INTEGER NOT NULL,
+    final_url TEXT NOT NULL,
+    content_type TEXT,
+    etag TEXT,
+    last_modified TEXT,
+    size_bytes INTEGER NOT NULL,
+    fetch_start_ms INTEGER NOT NULL,
+    fetch_duration_ms INTEGER NOT NULL,
+    cache_result TEXT
 );
 
 -- Schedule files.
 CREATE TABLE schedules(
     schedule_id INTEGER PRIMARY KEY,
 
+    -- The crawl run this file was crawled by.
+    crawl_run_id NOT NULL
+      REFERENCES crawl_runs(crawl_run_id)
+        ON DELETE CASCADE,
+
     -- The URL of the schedule file.
     url TEXT NOT NULL,
 
@@ -74,13 +270,39 @@ CREATE TABLE schedules(
     -- The schedule file's contents.
     -- See https://github.com/smart-on-fhir/smart-scheduling-links/blob/master/specification.md#schedule-file
     -- for file content definition.
-    contents TEXT NOT NULL
+    -- NULL unless storage is "contents".
+    contents TEXT,
+
+    -- How the file's contents are stored. See --storage.
+    -- "contents": in the contents column.
+    -- "lines": in schedule_lines.
+    -- "blob": in the blobs row whose sha256 matches this file's sha256.
+    storage TEXT NOT NULL,
+
+    -- The hex encoded SHA-256 of the file's contents.
+    sha256 TEXT NOT NULL,
+
+    -- Fetch metadata. See the manifests table for column definitions.
+    http_status INTEGER NOT NULL,
+    final_url TEXT NOT NULL,
+    content_type TEXT,
+    etag TEXT,
+    last_modified TEXT,
+    size_bytes INTEGER NOT NULL,
+    fetch_start_ms INTEGER NOT NULL,
+    fetch_duration_ms INTEGER NOT NULL,
+    cache_result TEXT
 );
 
 -- Slot files.
 CREATE TABLE slots(
     slot_id INTEGER PRIMARY KEY,
 
+    -- The crawl run this file was crawled by.
+    crawl_run_id NOT NULL
+      REFERENCES crawl_runs(crawl_run_id)
+        ON DELETE CASCADE,
+
     -- The URL of this slot file.
     url TEXT NOT NULL,
 
@@ -92,7 +314,120 @@ CREATE TABLE slots(
     -- The slot file's contents.
     -- See https://github.com/smart-on-fhir/smart-scheduling-links/blob/master/specification.md#slot-file
     -- for file content definition.
-    contents TEXT NOT NULL
+    -- NULL unless storage is "contents".
+    contents TEXT,
+
+    -- How the file's contents are stored. See --storage.
+    -- "contents": in the contents column.
+    -- "lines": in slot_lines.
+    -- "blob": in the blobs row whose sha256 matches this file's sha256.
+    storage TEXT NOT NULL,
+
+    -- The hex encoded SHA-256 of the file's contents.
+    sha256 TEXT NOT NULL,
+
+    -- Fetch metadata. See the manifests table for column definitions.
+    http_status INTEGER NOT NULL,
+    final_url TEXT NOT NULL,
+    content_type TEXT,
+    etag TEXT,
+    last_modified TEXT,
+    size_bytes INTEGER NOT NULL,
+    fetch_start_ms INTEGER NOT NULL,
+    fetch_duration_ms INTEGER NOT NULL,
+    cache_result TEXT
+);
+
+-- Contents of files stored with --storage=blob, keyed by the SHA-256 of the uncompressed contents.
+-- Identical files, e.g. unchanged files crawled by consecutive crawls into a --database, are stored once.
+CREATE TABLE blobs(
+    -- Hex encoded SHA-256 of the uncompressed contents.
+    sha256 TEXT PRIMARY KEY,
+
+    -- How data is compressed: "none", "gzip", or "zstd".
+    compression TEXT NOT NULL,
+
+    -- The size of the uncompressed contents in bytes.
+    size_bytes INTEGER NOT NULL,
+
+    data BLOB NOT NULL
+);
+
+-- Lines of location files stored with --storage=lines. Empty lines are not stored.
+CREATE TABLE location_lines(
+    location_id NOT NULL
+      REFERENCES locations(location_id)
+        ON DELETE CASCADE,
+
+    -- The 1-based line number within the file.
+    line_number INTEGER NOT NULL,
+
+    contents TEXT NOT NULL,
+
+    PRIMARY KEY (location_id, line_number)
+);
+
+-- Lines of schedule files stored with --storage=lines. Empty lines are not stored.
+CREATE TABLE schedule_lines(
+    schedule_id NOT NULL
+      REFERENCES schedules(schedule_id)
+        ON DELETE CASCADE,
+
+    -- The 1-based line number within the file.
+    line_number INTEGER NOT NULL,
+
+    contents TEXT NOT NULL,
+
+    PRIMARY KEY (schedule_id, line_number)
+);
+
+-- Lines of slot files stored with --storage=lines. Empty lines are not stored.
+CREATE TABLE slot_lines(
+    slot_id NOT NULL
+      REFERENCES slots(slot_id)
+        ON DELETE CASCADE,
+
+    -- The 1-based line number within the file.
+    line_number INTEGER NOT NULL,
+
+    contents TEXT NOT NULL,
+
+    PRIMARY KEY (slot_id, line_number)
+);
+
+-- Files which could not be crawled.
+CREATE TABLE crawl_errors(
+    crawl_error_id INTEGER PRIMARY KEY,
+
+    -- The crawl run the error occurred in.
+    crawl_run_id NOT NULL
+      REFERENCES crawl_runs(crawl_run_id)
+        ON DELETE CASCADE,
+
+    -- The URL of the file which could not be crawled.
+    url TEXT NOT NULL,
+
+    -- The URL of the manifest naming the file. Equal to url for manifest files.
+    manifest_url TEXT NOT NULL,
+
+    -- The host of url, e.g. "www.cvs.com".
+    host TEXT NOT NULL,
+
+    -- "manifest", "location", "schedule", or "slot".
+    file_type TEXT NOT NULL,
+
+    -- One of "http_429", "http_4xx", "http_5xx", "timeout", "network", "too_large", "policy", "local", "invalid", "malformed", "storage", or "other".
+    -- See ErrorClass in crawler/errors.go.
+    error_class TEXT NOT NULL,
+
+    -- The HTTP status code, if the failure was caused by an unexpected status code.
+    http_status INTEGER,
+
+    -- The error message.
+    message TEXT NOT NULL,
+
+    -- The number of attempts made to fetch the file.
+    attempts INTEGER NOT NULL
 );
 
 -- States is a list of states. If files are annotated with a state extension in the manifest file,
@@ -291,6 +626,21 @@ type CrawlStats struct {
 	// Maps host -> count.
 	hostToCount map[string]int
 
+	// Maps cache result (CacheFresh, CacheNotModified, CacheMiss) -> count.
+	cacheResultToCount map[string]int
+
+	// Maps manifest mode (ManifestModeFull, etc...) -> count.
+	manifestModeToCount map[string]int
+
+	// The number of leaf files copied from the previous snapshot.
+	copiedCount int
+
+	// The number of retried fetches.
+	retryCount int
+
+	// Files which could not be crawled.
+	failures []*CrawlFailure
+
 	// Records when the crawling started/ended.
 	startTime time.Time
 	endTime   time.Time
@@ -326,7 +676,7 @@ func (c *CrawlStats) Record(u, fileType string) {
 	count := c.fileTypeToCount[key]
 	c.fileTypeToCount[key] = count + 1
 
-	ur, err := url.Parse(u)
+	hostKey, err := HostOf(u)
 	// Skip recording malformed URLs.
 	if err != nil {
 		return
@@ -336,11 +686,76 @@ func (c *CrawlStats) Record(u, fileType string) {
 		c.hostToCount = make(map[string]int)
 	}
 
-	hostKey := ur.Host
 	count = c.hostToCount[hostKey]
 	c.hostToCount[hostKey] = count + 1
 }
 
+// Record a file which could not be crawled.
+func (c *CrawlStats) RecordFailure(f *CrawlFailure) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.failures = append(c.failures, f)
+}
+
+// Record how a manifest was crawled, and the number of leaf files copied from the previous snapshot.
+func (c *CrawlStats) RecordManifestMode(mode string, copied int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.manifestModeToCount == nil {
+		c.manifestModeToCount = make(map[string]int)
+	}
+	c.manifestModeToCount[mode]++
+	c.copiedCount += copied
+}
+
+// Record that a fetch was retried.
+func (c *CrawlStats) RecordRetry() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.retryCount++
+}
+
+// Returns the number of files crawled, including failures.
+func (c *CrawlStats) FileCount() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	count := 0
+	for _, v := range c.fileTypeToCount {
+		count += v
+	}
+	return count
+}
+
+// Returns the files which could not be crawled.
+func (c *CrawlStats) Failures() []*CrawlFailure {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]*CrawlFailure(nil), c.failures...)
+}
+
+// Cache results recorded by CrawlStats.RecordCacheResult.
+const (
+	// The file was served from the cache without a request.
+	CacheFresh = "fresh"
+	// The file was revalidated with the server, which responded 304 Not Modified.
+	CacheNotModified = "not modified"
+	// The file was downloaded.
+	CacheMiss = "miss"
+)
+
+// Record the cache result of a single fetch.
+func (c *CrawlStats) RecordCacheResult(result string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.cacheResultToCount == nil {
+		c.cacheResultToCount = make(map[string]int)
+	}
+	c.cacheResultToCount[result]++
+}
+
 // Returns pretty printed stats.
 func (c *CrawlStats) String() string {
 	c.mu.Lock()
@@ -362,29 +777,101 @@ func (c *CrawlStats) String() string {
 	for k, v := range c.hostToCount {
 		o += fmt.Sprintf("%s:\t%d\n", k, v)
 	}
+
+	if len(c.cacheResultToCount) > 0 {
+		o += "\nCache results:\n"
+		for k, v := range c.cacheResultToCount {
+			o += fmt.Sprintf("%s:\t%d\n", k, v)
+		}
+	}
+
+	if len(c.manifestModeToCount) > 0 {
+		o += "\nManifests by crawl mode:\n"
+		for k, v := range c.manifestModeToCount {
+			o += fmt.Sprintf("%s:\t%d\n", k, v)
+		}
+		o += fmt.Sprintf("Leaf files copied from the previous crawl: %d\n", c.copiedCount)
+	}
+
+	o += fmt.Sprintf("\nRetries: %d\n", c.retryCount)
+	if len(c.failures) > 0 {
+		o += fmt.Sprintf("\nFailed files (%d) by host and error class:\n", len(c.failures))
+		// Maps host -> error class -> count.
+		hostToClassToCount := make(map[string]map[string]int)
+		for _, f := range c.failures {
+			host := f.Host()
+			if hostToClassToCount[host] == nil {
+				hostToClassToCount[host] = make(map[string]int)
+			}
+			hostToClassToCount[host][ErrorClass(f.Err)]++
+		}
+		hosts := make([]string, 0, len(hostToClassToCount))
+		for host := range hostToClassToCount {
+			hosts = append(hosts, host)
+		}
+		sort.Strings(hosts)
+		for _, host := range hosts {
+			o += fmt.Sprintf("%s:\n", host)
+			for class, count := range hostToClassToCount[host] {
+				o += fmt.Sprintf("\t%s:\t%d\n", class, count)
+			}
+		}
+		o += "See the crawl_errors table in the output for details.\n"
+	}
 	o += "\n\n"
 	return o
 }
 
 // FetchFn is an interface for a function that takes a url and returns the
-// url's contents or an error.
-type FetcherFn func(url string) (string, error)
+// url's contents and fetch metadata, or an error. Implementations used by Run must be safe to call concurrently,
+// and must return promptly once ctx is done.
+type FetcherFn func(ctx context.Context, url string) (*FetchResult, error)
+
+// nullIfEmpty returns nil for empty strings so they are written as NULL.
+func nullIfEmpty(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+// InsertFile writes a file fetched by crawl run runId into table and returns its primary key.
+// columns and values are written in addition to the file's url, contents, and fetch metadata.
+func InsertFile(output *sql.DB, runId int64, table, u string, r *FetchResult, c *StoredContents, columns []string, values ...interface{}) (int64, error) {
+	columns = append([]string{
+		"crawl_run_id", "url", "contents", "storage", "sha256", "http_status", "final_url", "content_type", "etag", "last_modified",
+		"size_bytes", "fetch_start_ms", "fetch_duration_ms", "cache_result",
+	}, columns...)
+	values = append([]interface{}{
+		runId, u, c.Contents, c.Storage, c.Sha256, r.StatusCode, r.FinalUrl, nullIfEmpty(r.ContentType), nullIfEmpty(r.ETag), nullIfEmpty(r.LastModified),
+		c.SizeBytes, r.StartTime.UnixNano() / int64(time.Millisecond), r.Duration.Milliseconds(), nullIfEmpty(r.CacheResult),
+	}, values...)
+
+	sql := fmt.Sprintf("INSERT INTO %s (%s) VALUES (?%s)",
+		table, strings.Join(columns, ", "), strings.Repeat(", ?", len(columns)-1))
+	res, err := output.Exec(sql, values...)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
 
 // OpenOutput opens the specified outputFilename and loads schema into the file.
-// outputFilename must not exist.
+// The database is written into outputFilename+publish.PartialSuffix until published with publish.Output.
 // Returns the opened database, the actual filename, and error.
 func OpenOutput(outputFilenameTemplate, schema string) (*sql.DB, string, error) {
 	outputFilename := strings.ReplaceAll(
 		outputFilenameTemplate, "VERSION", fmt.Sprintf("%d", time.Now().Unix()))
+	partialFilename := outputFilename + publish.PartialSuffix
 
-	_ = os.Remove(outputFilename)
-	outputFile, err := os.Create(outputFilename)
+	_ = os.Remove(partialFilename)
+	outputFile, err := os.Create(partialFilename)
 	if err != nil {
 		return nil, "", err
 	}
 	outputFile.Close()
 
-	odb, err := sql.Open("sqlite3", outputFilename)
+	odb, err := sql.Open("sqlite3", partialFilename)
 	if err != nil {
 		return nil, "", err
 	}
@@ -398,80 +885,299 @@ func OpenOutput(outputFilenameTemplate, schema string) (*sql.DB, string, error)
 	return odb, outputFilename, nil
 }
 
-// CrawlManifest crawls the specified manifestUrl and writes the crawl results into output.
-func CrawlManifest(manifestUrl string, output *sql.DB, fetchFn FetcherFn, stats *CrawlStats) error {
-	log.Printf("Crawling Manifest file: %s.", manifestUrl)
-	stats.Record(manifestUrl, "manifest")
-	manifestBody, err := fetchFn(manifestUrl)
-	if err != nil {
+// leafFileTable describes where a leaf file of a given type is written in OutputSchema.
+type leafFileTable struct {
+	FileTable        string
+	LinesTable       string
+	StateJoinTable   string
+	StateJoinTableFK string
+}
+
+// leafFileTables maps the manifest output `type` to the leaf file's tables.
+var leafFileTables = map[string]leafFileTable{
+	"Location": {FileTable: "locations", LinesTable: "location_lines", StateJoinTable: "location_state", StateJoinTableFK: "location_id"},
+	"Schedule": {FileTable: "schedules", LinesTable: "schedule_lines", StateJoinTable: "schedule_state", StateJoinTableFK: "schedule_id"},
+	"Slot":     {FileTable: "slots", LinesTable: "slot_lines", StateJoinTable: "slot_state", StateJoinTableFK: "slot_id"},
+}
+
+// CrawlManifestOptions are the options for the CrawlManifest function.
+type CrawlManifestOptions struct {
+	// The URL of the manifest file.
+	ManifestUrl string
+
+	// The primary key of the publisher the manifest belongs to.
+	PublisherId int64
+
+	// The maximum number of leaf files crawled concurrently for this manifest.
+	// Values less than 1 are treated as 1.
+	FanOut int
+
+	// URL fetcher function. Must be safe to call concurrently.
+	Fetcher FetcherFn
+
+	// Output file to write crawl results to.
+	// Writes are serialized by the caller limiting the database to a single connection.
+	Output *sql.DB
+
+	// The crawl run files are recorded under.
+	RunId int64
+
+	// How leaf files are stored: StorageContents, StorageLines, or StorageBlob.
+	Storage string
+
+	// The compression used by StorageBlob.
+	Compression string
+
+	// The maximum line length of leaf files stored with StorageLines.
+	MaxLineBytes int
+
+	// Maps lower case file type ("manifest", "location", etc...) -> the maximum size of the file.
+	// File types without a limit are unlimited.
+	MaxResponseBytes map[string]int64
+
+	// Stats - CrawlStats.Record will be called for the manifest and every leaf file, and
+	// CrawlStats.RecordFailure for every file which cannot be crawled.
+	Stats *CrawlStats
+
+	// The previous crawl's output. If not nil, the manifest is crawled incrementally.
+	Previous *PreviousSnapshot
+
+	// The progress of the crawl run being resumed. If not nil and the manifest was already
+	// fetched, only its remaining leaf files are crawled.
+	Checkpoint *Checkpoint
+
+	// Whether leaf files must share the manifest's origin. Other leaf files are recorded as failures.
+	SameOriginLeafFiles bool
+
+	// Whether the leaf files of manifests which fail ValidateManifest are crawled. If false, invalid
+	// manifests are recorded as failures instead.
+	CrawlInvalidManifests bool
+}
+
+// CrawlManifest crawls the manifest with the given options and writes the crawl results into output.
+// Leaf files are fetched concurrently, up to opts.FanOut at a time.
+// Failures to crawl the manifest or its leaf files are recorded with RecordFailure, unless caused by ctx
+// being done. Once ctx is done no further files are fetched, and the manifest is left for --resume.
+func CrawlManifest(ctx context.Context, opts *CrawlManifestOptions) error {
+	if err := crawlManifest(ctx, opts); err != nil {
+		if ctx.Err() != nil {
+			return err
+		}
+		RecordFailure(opts.Output, opts.RunId, opts.Stats, &CrawlFailure{
+			Url:         opts.ManifestUrl,
+			ManifestUrl: opts.ManifestUrl,
+			FileType:    "manifest",
+			Err:         err,
+		})
 		return err
 	}
+	return nil
+}
 
-	res, err := output.Exec(
-		"INSERT INTO manifests (url, contents) VALUES (?, ?)",
-		manifestUrl, manifestBody)
-	if err != nil {
-		return err
+func crawlManifest(ctx context.Context, opts *CrawlManifestOptions) (err error) {
+	var manifestId int64
+	var contents string
+	// The URL the manifest was served from.
+	var finalUrl string
+	var since string
+	var hasPrevious bool
+	// Leaf files already crawled by the crawl run being resumed.
+	var crawled map[string]bool
+	var validationErrors []*ManifestValidationError
+	if m, ok := opts.Checkpoint.Manifest(opts.ManifestUrl); ok {
+		log.Printf("Resuming Manifest file: %s.", opts.ManifestUrl)
+		manifestId, contents, finalUrl, since, hasPrevious = m.Id, m.Contents, m.FinalUrl, m.Since, m.Since != ""
+		if crawled, err = opts.Checkpoint.LeafFileUrls(opts.Output, manifestId); err != nil {
+			return err
+		}
+		// Validation errors were recorded when the manifest was fetched.
+		validationErrors = ValidateManifest(finalUrl, contents)
+	} else {
+		log.Printf("Crawling Manifest file: %s.", opts.ManifestUrl)
+		opts.Stats.Record(opts.ManifestUrl, "manifest")
+
+		fetchUrl := opts.ManifestUrl
+		since, hasPrevious = opts.Previous.TransactionTime(opts.ManifestUrl)
+		if hasPrevious {
+			if fetchUrl, err = WithSince(opts.ManifestUrl, since); err != nil {
+				return err
+			}
+		}
+		manifest, err := opts.Fetcher(WithMaxResponseBytes(ctx, opts.MaxResponseBytes["manifest"]), fetchUrl)
+		if err != nil {
+			return err
+		}
+		// Manifests are small, and always stored whole.
+		c, err := ReadContents(manifest.Body)
+		manifest.Body.Close()
+		if err != nil {
+			return err
+		}
+		contents = *c.Contents
+		finalUrl = manifest.FinalUrl
+
+		// Record the manifest even if it cannot be parsed.
+		var mf ManifestFile
+		_ = json.Unmarshal([]byte(contents), &mf)
+		validationErrors = ValidateManifest(finalUrl, contents)
+		manifestId, err = InsertFile(opts.Output, opts.RunId, "manifests", opts.ManifestUrl, manifest, c,
+			[]string{"publisher_id", "transaction_time", "since", "valid"},
+			opts.PublisherId, nullIfEmpty(mf.TransactionTime), nullIfEmpty(since), len(validationErrors) == 0)
+		if err != nil {
+			return err
+		}
+		if err := RecordManifestValidationErrors(opts.Output, manifestId, validationErrors); err != nil {
+			return err
+		}
 	}
+	// Checkpoint the manifest once it was stored, even if it then fails, e.g. because it is invalid, so
+	// that --resume doesn't crawl it again. Interrupted manifests are left for --resume to finish.
+	// Manifests which could not be fetched or stored return before this, so --resume fetches them
+	// again, after ResumeCrawlRun deletes their crawl errors.
+	defer func() {
+		if ctx.Err() != nil {
+			return
+		}
+		if cerr := CheckpointManifest(opts.Output, manifestId, time.Now()); cerr != nil && err == nil {
+			err = cerr
+		}
+	}()
 
-	manifestId, err := res.LastInsertId()
-	if err != nil {
-		return err
+	if len(validationErrors) > 0 {
+		if !opts.CrawlInvalidManifests {
+			return &InvalidManifestError{Url: opts.ManifestUrl, Errors: validationErrors}
+		}
+		log.Printf("Manifest %s is invalid (%d errors), crawling it anyway.", opts.ManifestUrl, len(validationErrors))
 	}
 
 	var mf ManifestFile
-	err = json.Unmarshal([]byte(manifestBody), &mf)
-	if err != nil {
+	if err := json.Unmarshal([]byte(contents), &mf); err != nil {
 		return err
 	}
-	for _, o := range mf.Output {
-		if o.FileType == "Location" {
-			if err := CrawlLeafFile(&CrawlLeafFileOptions{
-				FileInfo:         &o,
-				ManifestId:       manifestId,
-				FileTable:        "locations",
-				StateJoinTable:   "location_state",
-				StateJoinTableFK: "location_id",
-				Fetcher:          fetchFn,
-				Output:           output,
-				Stats:            stats,
-			}); err != nil {
-				log.Printf("Unable to crawl location file %s: %s", o.Url, err)
-			}
-		} else if o.FileType == "Schedule" {
-			if err := CrawlLeafFile(&CrawlLeafFileOptions{
-				FileInfo:         &o,
-				ManifestId:       manifestId,
-				FileTable:        "schedules",
-				StateJoinTable:   "schedule_state",
-				StateJoinTableFK: "schedule_id",
-				Fetcher:          fetchFn,
-				Output:           output,
-				Stats:            stats,
-			}); err != nil {
-				log.Printf("Unable to crawl schedule file %s: %s", o.Url, err)
-			}
-		} else if o.FileType == "Slot" {
-			if err := CrawlLeafFile(&CrawlLeafFileOptions{
-				FileInfo:         &o,
-				ManifestId:       manifestId,
-				FileTable:        "slots",
-				StateJoinTable:   "slot_state",
-				StateJoinTableFK: "slot_id",
-				Fetcher:          fetchFn,
-				Output:           output,
-				Stats:            stats,
-			}); err != nil {
-				log.Printf("Unable to crawl slot file %s: %s", o.Url, err)
+	for i := range mf.Output {
+		mf.Output[i].Url = ResolveUrl(finalUrl, mf.Output[i].Url)
+	}
+
+	if hasPrevious && mf.TransactionTime == since {
+		log.Printf("Manifest %s unchanged since %s, reusing previous crawl.", opts.ManifestUrl, since)
+		copied, err := opts.Previous.CopyLeafFiles(opts.ManifestUrl, opts.Output, opts.RunId, manifestId)
+		opts.Stats.RecordManifestMode(ManifestModeUnchanged, copied)
+		return err
+	}
+
+	fanOut := opts.FanOut
+	if fanOut < 1 {
+		fanOut = 1
+	}
+	sem := make(chan struct{}, fanOut)
+	var wg sync.WaitGroup
+Outputs:
+	for i := range mf.Output {
+		o := &mf.Output[i]
+		table, ok := leafFileTables[o.FileType]
+		if !ok {
+			log.Printf("Unknown output file type '%s' specified in manifest %s.", o.FileType, opts.ManifestUrl)
+			continue
+		}
+		if crawled[o.Url] {
+			continue
+		}
+		if err := CheckLocalLeafFile(opts.ManifestUrl, o.Url); err != nil {
+			RecordFailure(opts.Output, opts.RunId, opts.Stats, &CrawlFailure{
+				Url:         o.Url,
+				ManifestUrl: opts.ManifestUrl,
+				FileType:    strings.ToLower(o.FileType),
+				Err:         err,
+			})
+			continue
+		}
+		if opts.SameOriginLeafFiles {
+			if err := CheckSameOrigin(opts.ManifestUrl, o.Url); err != nil {
+				RecordFailure(opts.Output, opts.RunId, opts.Stats, &CrawlFailure{
+					Url:         o.Url,
+					ManifestUrl: opts.ManifestUrl,
+					FileType:    strings.ToLower(o.FileType),
+					Err:         err,
+				})
+				continue
 			}
-		} else {
-			log.Printf("Unknown output file type '%s' specified in manifest %s.", o.FileType, manifestUrl)
 		}
+
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			break Outputs
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			if err := CrawlLeafFile(ctx, &CrawlLeafFileOptions{
+				FileInfo:     o,
+				ManifestId:   manifestId,
+				Table:        table,
+				Storage:      opts.Storage,
+				Compression:  opts.Compression,
+				MaxLineBytes: opts.MaxLineBytes,
+				MaxBytes:     opts.MaxResponseBytes[strings.ToLower(o.FileType)],
+				Fetcher:      opts.Fetcher,
+				Output:       opts.Output,
+				RunId:        opts.RunId,
+				Stats:        opts.Stats,
+			}); err != nil && ctx.Err() == nil {
+				RecordFailure(opts.Output, opts.RunId, opts.Stats, &CrawlFailure{
+					Url:         o.Url,
+					ManifestUrl: opts.ManifestUrl,
+					FileType:    strings.ToLower(o.FileType),
+					Err:         err,
+				})
+			}
+		}()
+	}
+	wg.Wait()
+	if ctx.Err() != nil {
+		return ctx.Err()
 	}
 
+	// Publishers which support _since echo it in the manifest's request URL. Publishers which
+	// don't return every file, in which case there is nothing to merge.
+	// Files fetched with _since only hold the resources which changed, even if they have the same
+	// URL as a previous file, so every previous file is kept. The parser reads the changed files
+	// first, and skips the resources they supersede.
+	if hasPrevious && strings.Contains(mf.Request, "_since=") {
+		copied, err := opts.Previous.CopyLeafFiles(opts.ManifestUrl, opts.Output, opts.RunId, manifestId)
+		opts.Stats.RecordManifestMode(ManifestModeIncremental, copied)
+		return err
+	}
+	opts.Stats.RecordManifestMode(ManifestModeFull, 0)
+
 	return nil
 }
 
+// LimitConcurrency returns a FetcherFn that allows at most n concurrent calls to fetchFn.
+// A call is in progress until the returned body is closed.
+// Values of n less than 1 are treated as 1.
+func LimitConcurrency(fetchFn FetcherFn, n int) FetcherFn {
+	if n < 1 {
+		n = 1
+	}
+	sem := make(chan struct{}, n)
+	return func(ctx context.Context, url string) (*FetchResult, error) {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		release := func() { <-sem }
+		result, err := fetchFn(ctx, url)
+		if err != nil {
+			release()
+			return nil, err
+		}
+		return releaseOnClose(result, release), nil
+	}
+}
+
 // CrawlLeafFileOptions are the options for the CrawLeafFile function.
 type CrawlLeafFileOptions struct {
 	// File information, as parsed from the Manifest file's output JSON.
@@ -480,14 +1186,20 @@ type CrawlLeafFileOptions struct {
 	// The manifest file primary key which this leaf file belongs to.
 	ManifestId int64
 
-	// The table name in which to write the leaf file's contents, e.g. "locations".
-	FileTable string
+	// The tables in which to write the leaf file's contents and state extensions, e.g. "slots" and "slot_state".
+	Table leafFileTable
 
-	// The state join table name in which to write state entensions, e.g. "slot_state".
-	StateJoinTable string
+	// How the leaf file is stored: StorageContents, StorageLines, or StorageBlob.
+	Storage string
 
-	// The leaf file's state join table column name, e.g. "slot_id".
-	StateJoinTableFK string
+	// The compression used if Storage is StorageBlob.
+	Compression string
+
+	// The maximum line length if Storage is StorageLines.
+	MaxLineBytes int
+
+	// The maximum size of the file. 0 if unlimited.
+	MaxBytes int64
 
 	// URL fetcher function.
 	Fetcher FetcherFn
@@ -495,27 +1207,70 @@ type CrawlLeafFileOptions struct {
 	// Output file to write crawl results to.
 	Output *sql.DB
 
+	// The crawl run files are recorded under.
+	RunId int64
+
 	// Stats - CrawlStats.Record(FileInfo.FileType) will be called.
 	Stats *CrawlStats
 }
 
 // CrawlLeafFile crawls a non-manifest file with the given options.
-func CrawlLeafFile(opts *CrawlLeafFileOptions) error {
+// Fetching the file stops once ctx is done.
+func CrawlLeafFile(ctx context.Context, opts *CrawlLeafFileOptions) error {
 	log.Printf("Crawling %s file: %s.", opts.FileInfo.FileType, opts.FileInfo.Url)
 	opts.Stats.Record(opts.FileInfo.Url, opts.FileInfo.FileType)
-	body, err := opts.Fetcher(opts.FileInfo.Url)
-	if err != nil {
-		return err
-	}
-
-	sql := fmt.Sprintf("INSERT INTO %s (url, manifest_id, contents) VALUES (?, ?, ?)", opts.FileTable)
-	res, err := opts.Output.Exec(sql, opts.FileInfo.Url, opts.ManifestId, body)
+	result, err := opts.Fetcher(WithMaxResponseBytes(ctx, opts.MaxBytes), opts.FileInfo.Url)
 	if err != nil {
 		return err
 	}
-	leafFileId, err := res.LastInsertId()
-	if err != nil {
-		return err
+	defer result.Body.Close()
+
+	var leafFileId int64
+	switch opts.Storage {
+	case StorageLines:
+		// Insert the file first so that its lines can reference it, then record its size, hash, and fetch
+		// duration once streamed.
+		leafFileId, err = InsertFile(opts.Output, opts.RunId, opts.Table.FileTable, opts.FileInfo.Url, result,
+			&StoredContents{Storage: StorageLines}, []string{"manifest_id"}, opts.ManifestId)
+		if err != nil {
+			return err
+		}
+		size, hash, err := WriteLines(opts.Output, opts.Table, leafFileId, result.Body, opts.MaxLineBytes)
+		if err == nil {
+			_, err = opts.Output.Exec(
+				fmt.Sprintf("UPDATE %s SET size_bytes = ?, sha256 = ?, fetch_duration_ms = ? WHERE %s = ?",
+					opts.Table.FileTable, opts.Table.StateJoinTableFK),
+				size, hash, result.Duration.Milliseconds(), leafFileId)
+		}
+		if err != nil {
+			// Don't publish a partially stored file. Its lines are deleted by cascade.
+			if _, derr := opts.Output.Exec(
+				fmt.Sprintf("DELETE FROM %s WHERE %s = ?", opts.Table.FileTable, opts.Table.StateJoinTableFK),
+				leafFileId); derr != nil {
+				log.Printf("Unable to delete partially stored %s file %s: %s", opts.FileInfo.FileType, opts.FileInfo.Url, derr)
+			}
+			return err
+		}
+	case StorageBlob:
+		contents, err := WriteBlob(opts.Output, result.Body, opts.Compression)
+		if err != nil {
+			return err
+		}
+		leafFileId, err = InsertFile(opts.Output, opts.RunId, opts.Table.FileTable, opts.FileInfo.Url, result, contents,
+			[]string{"manifest_id"}, opts.ManifestId)
+		if err != nil {
+			return err
+		}
+	default:
+		contents, err := ReadContents(result.Body)
+		if err != nil {
+			return err
+		}
+		leafFileId, err = InsertFile(opts.Output, opts.RunId, opts.Table.FileTable, opts.FileInfo.Url, result, contents,
+			[]string{"manifest_id"}, opts.ManifestId)
+		if err != nil {
+			return err
+		}
 	}
 
 	for _, state := range opts.FileInfo.Extension.State {
@@ -524,8 +1279,8 @@ func CrawlLeafFile(opts *CrawlLeafFileOptions) error {
 			log.Printf("Failed to find state id for %s", state)
 			continue
 		}
-		joinTableSql := fmt.Sprintf("INSERT INTO %s (%s, state_id) VALUES (%d, %d)", opts.StateJoinTable,
-			opts.StateJoinTableFK,
+		joinTableSql := fmt.Sprintf("INSERT INTO %s (%s, state_id) VALUES (%d, %d)", opts.Table.StateJoinTable,
+			opts.Table.StateJoinTableFK,
 			leafFileId, stateId)
 		_, err := opts.Output.Exec(joinTableSql)
 		if err != nil {
@@ -553,49 +1308,292 @@ func LoadManifestUrls(manifestFile string) ([]string, error) {
 	return filtered, nil
 }
 
-func Run() error {
+// Run crawls the manifests of the publishers in --publishers or --manifest_urls. Once ctx is done, in-flight fetches are stopped and
+// the crawl run is recorded as interrupted.
+func Run(ctx context.Context) error {
 	var stats CrawlStats
-	log.Printf("Loading manifest urls from %s.", *manifestUrls)
-	urls, err := LoadManifestUrls(*manifestUrls)
+	var registry *PublisherRegistry
+	if *publishers != "" {
+		log.Printf("Loading publishers from %s.", *publishers)
+		var err error
+		if registry, err = LoadPublisherRegistry(*publishers); err != nil {
+			return err
+		}
+	} else {
+		log.Printf("Loading manifest urls from %s.", *manifestUrls)
+		urls, err := LoadManifestUrls(*manifestUrls)
+		if err != nil {
+			return err
+		}
+		registry = PublisherRegistryFromManifestUrls(urls)
+	}
+
+	defaultLimits := HostLimits{QPS: *hostMaxQPS, MaxInFlight: *hostMaxInFlight}
+	overrides, err := registry.HostOverrides(defaultLimits)
 	if err != nil {
 		return err
 	}
-
-	odb, outputFilename, err := OpenOutput(*output, OutputSchema)
+	// --host_overrides takes precedence over the publishers' rate limits.
+	flagOverrides, err := ParseHostOverrides(*hostOverrides, defaultLimits)
+	if err != nil {
+		return err
+	}
+	for host, limits := range flagOverrides {
+		overrides[host] = limits
+	}
+	hostPolicy := &HostPolicy{Default: defaultLimits, Overrides: overrides}
+	responseLimits, err := ParseMaxResponseBytes(*maxResponseBytes)
 	if err != nil {
 		return err
 	}
-	defer odb.Close()
 
-	var fetchFn FetcherFn = func(url string) (string, error) {
-		resp, err := http.Get(url)
-		if err != nil {
-			return "", err
+	switch *storage {
+	case StorageContents, StorageLines, StorageBlob:
+	default:
+		return fmt.Errorf("unknown --storage '%s': must be '%s', '%s', or '%s'", *storage, StorageContents, StorageLines, StorageBlob)
+	}
+	switch *compression {
+	case CompressionNone, CompressionGzip, CompressionZstd:
+	default:
+		return fmt.Errorf("unknown --compression '%s': must be '%s', '%s', or '%s'", *compression, CompressionNone, CompressionGzip, CompressionZstd)
+	}
+	if *recordFixtures != "" && *recordFixtures == *replayFixtures {
+		return fmt.Errorf("--record_fixtures and --replay_fixtures must be different directories")
+	}
+
+	var odb *sql.DB
+	var outputFilename string
+	var previous *PreviousSnapshot
+	var checkpoint *Checkpoint
+	if *database != "" {
+		outputFilename = *database
+		if odb, err = OpenDatabase(*database, OutputSchema); err != nil {
+			return err
+		}
+		defer odb.Close()
+
+		if *incremental {
+			log.Printf("Crawling incrementally from the latest crawl in %s.", *database)
+			// The snapshot shares odb, which is closed above.
+			if previous, err = LoadPreviousSnapshot(odb); err != nil {
+				return err
+			}
+		}
+	} else {
+		// The output file of the crawl run being resumed.
+		var resumeFilename string
+		previousFilename := *previousOutput
+		if *resume {
+			partials, err := FindOutputs(*output + publish.PartialSuffix)
+			if err != nil {
+				return err
+			}
+			if len(partials) == 0 {
+				return fmt.Errorf("no unpublished crawler output matching %s%s to resume", *output, publish.PartialSuffix)
+			}
+			resumeFilename = strings.TrimSuffix(partials[len(partials)-1], publish.PartialSuffix)
+			// The crawl being resumed was incremental to the latest output published before it.
+			if previousFilename == "" {
+				outputs, err := FindOutputs(*output)
+				if err != nil {
+					return err
+				}
+				for _, o := range outputs {
+					if o < resumeFilename {
+						previousFilename = o
+					}
+				}
+			}
+		} else if *incremental && previousFilename == "" {
+			if previousFilename, err = FindPreviousOutput(*output); err != nil {
+				return err
+			}
+		}
+
+		if *incremental {
+			if previousFilename == "" {
+				log.Print("No previous crawler output found, crawling in full.")
+			} else {
+				log.Printf("Crawling incrementally from previous output %s.", previousFilename)
+				if previous, err = OpenPreviousSnapshot(previousFilename); err != nil {
+					return err
+				}
+				defer previous.Close()
+			}
+		}
+
+		if resumeFilename != "" {
+			outputFilename = resumeFilename
+			if odb, err = OpenDatabase(resumeFilename+publish.PartialSuffix, OutputSchema); err != nil {
+				return err
+			}
+		} else if odb, outputFilename, err = OpenOutput(*output, OutputSchema); err != nil {
+			return err
 		}
-		defer resp.Body.Close()
-		bodyBuffer := new(strings.Builder)
-		if _, err := io.Copy(bodyBuffer, resp.Body); err != nil {
-			return "", err
+		defer odb.Close()
+		// SQLite allows a single writer. Funnel all crawler goroutines through one connection so that
+		// writes are serialized rather than failing with "database is locked".
+		odb.SetMaxOpenConns(1)
+	}
+
+	if *resume {
+		if checkpoint, err = LoadCheckpoint(odb); err != nil {
+			return fmt.Errorf("cannot resume %s: %s", outputFilename, err)
 		}
-		return bodyBuffer.String(), nil
+	}
+
+	urlPolicy := &URLPolicy{AllowPrivateAddresses: *allowPrivateAddresses, MaxRedirects: *maxRedirects}
+	client, err := NewHTTPClient(&HTTPClientOptions{
+		ConnectTimeout: *connectTimeout,
+		ReadTimeout:    *readTimeout,
+		Timeout:        *fetchTimeout,
+		UserAgent:      *userAgent,
+		Proxy:          *proxy,
+		CABundle:       *caBundle,
+		Policy:         urlPolicy,
+	})
+	if err != nil {
+		return err
+	}
+	authenticators, err := registry.Authenticators(client)
+	if err != nil {
+		return err
+	}
+	fetcher := &HTTPFetcher{
+		Client:         client,
+		Authenticators: authenticators,
+		ReadTimeout:    *readTimeout,
+		Stats:          &stats,
+	}
+	if *cacheDir != "" {
+		fetcher.Cache = &DiskCache{Dir: *cacheDir}
+	}
+	var fetchFn FetcherFn = fetcher.Fetch
+	fetchFn = LimitConcurrency(fetchFn, *concurrency)
+	// Wait on per-host limits before taking a global concurrency slot so that a
+	// slow host does not starve fetches to other hosts.
+	fetchFn = hostPolicy.Wrap(fetchFn)
+	// Retry outside of the limiters so that backoff does not hold any slots, while
+	// every attempt is still subject to them.
+	fetchFn = (&Retrier{
+		MaxAttempts: *maxAttempts,
+		BaseDelay:   *retryBaseWait,
+		MaxDelay:    *retryMaxWait,
+		Budget:      NewRetryBudget(*retryBudget),
+		Stats:       &stats,
+	}).Wrap(fetchFn)
+	// Rejected URLs are neither retried nor counted against the limiters.
+	fetchFn = urlPolicy.Wrap(fetchFn)
+	// file:// URLs are read from the local filesystem, bypassing the HTTP policy and limiters.
+	fetchFn = (&LocalFetcher{}).Wrap(fetchFn)
+	// Replayed crawls never reach the network, so the client and limiters above are unused.
+	if *replayFixtures != "" {
+		fetchFn = (&FixtureArchive{Dir: *replayFixtures}).Replay
+	}
+	if *recordFixtures != "" {
+		fetchFn = (&FixtureArchive{Dir: *recordFixtures}).Record(fetchFn)
 	}
 
 	stats.CrawlStart()
-	log.Printf("Crawling %d manifests.", len(urls))
-	for _, url := range urls {
-		if err := CrawlManifest(url, odb, fetchFn, &stats); err != nil {
-			log.Printf("Failed to crawl manifest %s: %s.", url, err)
+	var runId int64
+	if checkpoint != nil {
+		runId = checkpoint.RunId
+		if err := ResumeCrawlRun(odb, checkpoint); err != nil {
+			return err
+		}
+	} else if runId, err = StartCrawlRun(odb, FlagConfig(), time.Now()); err != nil {
+		return err
+	}
+	publisherIds, err := RecordPublishers(odb, runId, registry)
+	if err != nil {
+		return err
+	}
+
+	var urls []string
+	for _, p := range registry.Enabled() {
+		if !checkpoint.Crawled(p.ManifestUrl) {
+			urls = append(urls, p.ManifestUrl)
 		}
 	}
+	if checkpoint != nil {
+		log.Printf("Resuming crawl run %d: %d of %d manifests remaining.", runId, len(urls), len(registry.Enabled()))
+	}
+	log.Printf("Crawling %d manifests with concurrency %d.", len(urls), *concurrency)
+	var wg sync.WaitGroup
+	for _, url := range urls {
+		wg.Add(1)
+		go func(url string) {
+			defer wg.Done()
+			// Failures are recorded by CrawlManifest.
+			_ = CrawlManifest(ctx, &CrawlManifestOptions{
+				ManifestUrl:           url,
+				PublisherId:           publisherIds[url],
+				FanOut:                *fanOut,
+				Fetcher:               fetchFn,
+				Output:                odb,
+				RunId:                 runId,
+				Storage:               *storage,
+				Compression:           *compression,
+				MaxLineBytes:          *maxLineBytes,
+				MaxResponseBytes:      responseLimits,
+				Stats:                 &stats,
+				Previous:              previous,
+				Checkpoint:            checkpoint,
+				SameOriginLeafFiles:   *sameOriginLeafFiles,
+				CrawlInvalidManifests: *crawlInvalidManifests,
+			})
+		}(url)
+	}
+	wg.Wait()
 	stats.CrawlEnd()
 	log.Print(stats.String())
-	log.Printf("Output written to %s.", outputFilename)
+	status := CrawlRunComplete
+	if ctx.Err() != nil {
+		status = CrawlRunInterrupted
+	}
+	if err := EndCrawlRun(odb, runId, status, &stats, time.Now()); err != nil {
+		return err
+	}
+	if status == CrawlRunInterrupted {
+		if *database == "" {
+			outputFilename += publish.PartialSuffix
+		}
+		return fmt.Errorf("crawl run %d in %s was interrupted: rerun with --resume to finish it", runId, outputFilename)
+	}
+
+	if *database != "" && *retainRuns > 0 {
+		pruned, err := PruneCrawlRuns(odb, *retainRuns)
+		if err != nil {
+			return err
+		}
+		log.Printf("Pruned %d crawl runs older than the latest %d.", pruned, *retainRuns)
+	}
+	if *database == "" {
+		if err := publish.Output(odb, outputFilename, *latest); err != nil {
+			return fmt.Errorf("cannot publish %s: %s", outputFilename, err)
+		}
+	}
+	log.Printf("Output written to %s (crawl run %d).", outputFilename, runId)
 
 	return nil
 }
 
 func main() {
-	if err := Run(); err != nil {
+	flag.Parse()
+	rand.Seed(time.Now().UnixNano())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		log.Printf("Received %s, stopping the crawl. Send it again to exit immediately.", sig)
+		// Restore the default behavior so that a second signal kills the crawler.
+		signal.Stop(signals)
+		cancel()
+	}()
+
+	if err := Run(ctx); err != nil {
 		log.Fatal(err)
 	}
 }
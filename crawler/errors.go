@@ -0,0 +1,159 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"os"
+
+	sqlite3 "github.com/mattn/go-sqlite3"
+)
+
+// Error classes recorded in the crawl_errors table. See ErrorClass.
+const (
+	// The publisher responded 429 Too Many Requests.
+	ErrorClassRateLimited = "http_429"
+	// The publisher responded with any other 4xx status code.
+	ErrorClassHTTPClient = "http_4xx"
+	// The publisher responded with a 5xx status code.
+	ErrorClassHTTPServer = "http_5xx"
+	// The request timed out.
+	ErrorClassTimeout = "timeout"
+	// The connection failed, e.g. DNS resolution, connection refused, TLS errors.
+	ErrorClassNetwork = "network"
+	// The response was larger than --max_response_bytes.
+	ErrorClassTooLarge = "too_large"
+	// The URL was rejected by the URLPolicy, e.g. it points at a private address.
+	ErrorClassPolicy = "policy"
+	// A local file could not be read. See LocalFetcher.
+	ErrorClassLocal = "local"
+	// The manifest failed validation. See the manifest_validation_errors table.
+	ErrorClassInvalid = "invalid"
+	// The file was fetched but could not be parsed.
+	ErrorClassMalformed = "malformed"
+	// The file could not be written to the output.
+	ErrorClassStorage = "storage"
+	// Any other error.
+	ErrorClassOther = "other"
+)
+
+// ErrorClass classifies err into one of the ErrorClass* constants.
+func ErrorClass(err error) string {
+	var replayedErr *ReplayedError
+	if errors.As(err, &replayedErr) {
+		return replayedErr.Class
+	}
+
+	// Checked first, since policy errors returned by the dialer are wrapped in net.Errors.
+	var policyErr *PolicyError
+	if errors.As(err, &policyErr) {
+		return ErrorClassPolicy
+	}
+
+	var statusErr *HTTPStatusError
+	if errors.As(err, &statusErr) {
+		switch {
+		case statusErr.StatusCode == http.StatusTooManyRequests:
+			return ErrorClassRateLimited
+		case statusErr.StatusCode >= 500:
+			return ErrorClassHTTPServer
+		default:
+			return ErrorClassHTTPClient
+		}
+	}
+
+	var invalidErr *InvalidManifestError
+	if errors.As(err, &invalidErr) {
+		return ErrorClassInvalid
+	}
+
+	// Checked before net.Error, which *os.PathError implements.
+	var pathErr *os.PathError
+	if errors.As(err, &pathErr) {
+		return ErrorClassLocal
+	}
+
+	var tooLargeErr *ResponseTooLargeError
+	if errors.As(err, &tooLargeErr) {
+		return ErrorClassTooLarge
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		if netErr.Timeout() {
+			return ErrorClassTimeout
+		}
+		return ErrorClassNetwork
+	}
+
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &syntaxErr) || errors.As(err, &typeErr) {
+		return ErrorClassMalformed
+	}
+
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		return ErrorClassStorage
+	}
+
+	return ErrorClassOther
+}
+
+// CrawlFailure is a file which could not be crawled.
+type CrawlFailure struct {
+	// The URL of the file.
+	Url string
+
+	// The URL of the manifest naming the file. Equal to Url for manifest files.
+	ManifestUrl string
+
+	// "manifest", "location", "schedule", or "slot".
+	FileType string
+
+	// The error which caused the failure.
+	Err error
+}
+
+// Host returns the failed file's host, or "" if Url is malformed.
+func (f *CrawlFailure) Host() string {
+	host, _ := HostOf(f.Url)
+	return host
+}
+
+// Attempts returns the number of attempts made to fetch the file.
+func (f *CrawlFailure) Attempts() int {
+	var fetchErr *FetchError
+	if errors.As(f.Err, &fetchErr) {
+		return fetchErr.Attempts
+	}
+	return 1
+}
+
+// HTTPStatus returns the HTTP status code of the failed fetch, or nil if the
+// failure wasn't caused by an unexpected status code.
+func (f *CrawlFailure) HTTPStatus() interface{} {
+	var statusErr *HTTPStatusError
+	if errors.As(f.Err, &statusErr) {
+		return statusErr.StatusCode
+	}
+	return nil
+}
+
+// RecordFailure records f into stats and the output's crawl_errors table under crawl run runId.
+// Errors writing to output are logged, since there is nowhere else to record them.
+func RecordFailure(output *sql.DB, runId int64, stats *CrawlStats, f *CrawlFailure) {
+	log.Printf("Unable to crawl %s file %s: %s", f.FileType, f.Url, f.Err)
+	stats.RecordFailure(f)
+
+	if _, err := output.Exec(`
+      INSERT INTO crawl_errors
+        (crawl_run_id, url, manifest_url, host, file_type, error_class, http_status, message, attempts)
+      VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		runId, f.Url, f.ManifestUrl, f.Host(), f.FileType, ErrorClass(f.Err), f.HTTPStatus(), f.Err.Error(), f.Attempts()); err != nil {
+		log.Printf("Unable to record crawl error for %s: %s", f.Url, err)
+	}
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// FetchResult is a fetched file and metadata about how it was fetched.
+type FetchResult struct {
+	// The file's contents, streamed from the server or the cache. Must be closed by the caller.
+	Body io.ReadCloser
+
+	// The HTTP status code of the response. For 304 revalidations and fresh cache hits,
+	// this is the status code of the cached response.
+	StatusCode int
+
+	// The URL the contents were served from, after following redirects.
+	FinalUrl string
+
+	// Response headers. May be empty.
+	ContentType  string
+	ETag         string
+	LastModified string
+
+	// The cache result (CacheFresh, CacheNotModified, CacheMiss), or "" if caching is disabled.
+	CacheResult string
+
+	// When the fetch started, and how long it took until Body was fully read or closed. Duration is
+	// set by timeBody, and is only final once Body was read to the end or closed.
+	StartTime time.Time
+	Duration  time.Duration
+}
+
+// timedBody sets its result's Duration once it is read to the end or closed.
+type timedBody struct {
+	io.ReadCloser
+	result *FetchResult
+	done   bool
+}
+
+func (b *timedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err == io.EOF {
+		b.end()
+	}
+	return n, err
+}
+
+func (b *timedBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.end()
+	return err
+}
+
+func (b *timedBody) end() {
+	if !b.done {
+		b.done = true
+		b.result.Duration = time.Since(b.result.StartTime)
+	}
+}
+
+// timeBody wraps r's body so that r.Duration measures the fetch until the body is fully read or closed.
+func timeBody(r *FetchResult) *FetchResult {
+	r.Duration = time.Since(r.StartTime)
+	r.Body = &timedBody{ReadCloser: r.Body, result: r}
+	return r
+}
+
+// HTTPFetcher fetches URLs over HTTP(S), optionally through an on-disk cache.
+// Thread safe.
+type HTTPFetcher struct {
+	// The client used to issue requests.
+	Client *http.Client
+
+	// The on-disk cache. nil disables caching.
+	Cache *DiskCache
+
+	// Maps origin (see OriginOf) -> the Authenticator of requests to it. May be nil.
+	Authenticators map[string]Authenticator
+
+	// The maximum time a single read of a response body may block. 0 disables the timeout.
+	ReadTimeout time.Duration
+
+	// Stats - CrawlStats.RecordCacheResult will be called for every fetch when Cache is not nil.
+	Stats *CrawlStats
+}
+
+// Fetch implements FetcherFn.
+//
+// Non-2xx responses are returned as *HTTPStatusError.
+// Fresh cache entries are returned without issuing a request. Stale entries are revalidated
+// with If-None-Match/If-Modified-Since, and a 304 response reuses the cached body.
+// Cacheable responses are streamed into the cache before being returned, so that truncated
+// downloads fail (and may be retried) here rather than while the caller reads the body.
+// Responses larger than the limit set on ctx by WithMaxResponseBytes, including those served from
+// the cache, fail with *ResponseTooLargeError.
+// FetchResult.Duration includes reading the body, whether it is served from the cache or the network.
+// Requests rejected with 401 Unauthorized are sent again once with fresh credentials, if the publisher's
+// Authenticator implements CredentialInvalidator.
+// Fetches with WithResumeRange bypass the cache, and return a 206 response with the rest of the body
+// if the server supports range requests.
+func (f *HTTPFetcher) Fetch(ctx context.Context, u string) (*FetchResult, error) {
+	start := time.Now()
+	maxBytes := responseByteLimit(ctx)
+	resume, resuming := resumeRangeOf(ctx)
+
+	var entry *CacheEntry
+	if f.Cache != nil && !resuming {
+		entry = f.Cache.Load(u)
+		if entry != nil && entry.Fresh(start) {
+			body, err := f.openCachedBody(u, maxBytes)
+			if err != nil {
+				return nil, err
+			}
+			f.Stats.RecordCacheResult(CacheFresh)
+			return entry.result(body, CacheFresh, start), nil
+		}
+	}
+
+	resp, cancel, err := f.send(ctx, u, entry, resume, resuming)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = newTimeoutBody(resp.Body, u, f.ReadTimeout, cancel)
+
+	if entry != nil && resp.StatusCode == http.StatusNotModified {
+		resp.Body.Close()
+		f.Stats.RecordCacheResult(CacheNotModified)
+		entry.Expires = ExpiresAt(resp.Header, time.Now())
+		if etag := resp.Header.Get("ETag"); etag != "" {
+			entry.ETag = etag
+		}
+		if err := f.Cache.Store(entry); err != nil {
+			log.Printf("Unable to update cache entry for %s: %s", u, err)
+		}
+		body, err := f.openCachedBody(u, maxBytes)
+		if err != nil {
+			return nil, err
+		}
+		return entry.result(body, CacheNotModified, start), nil
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		resp.Body.Close()
+		return nil, &HTTPStatusError{
+			Url:        u,
+			StatusCode: resp.StatusCode,
+			RetryAfter: ParseRetryAfter(resp.Header.Get("Retry-After"), time.Now()),
+		}
+	}
+
+	if resp.StatusCode == http.StatusPartialContent {
+		if !resuming || !strings.HasPrefix(resp.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-", resume.offset)) {
+			resp.Body.Close()
+			return nil, fmt.Errorf("GET %s: unexpected Content-Range %q", u, resp.Header.Get("Content-Range"))
+		}
+	}
+	if maxBytes > 0 {
+		// The limit applies to the whole body, not just the requested range.
+		var skipped int64
+		if resp.StatusCode == http.StatusPartialContent {
+			skipped = resume.offset
+		}
+		if skipped+resp.ContentLength > maxBytes {
+			resp.Body.Close()
+			return nil, &ResponseTooLargeError{Url: u, MaxBytes: maxBytes}
+		}
+		resp.Body = &limitedBody{ReadCloser: resp.Body, url: u, maxBytes: maxBytes, read: skipped}
+	}
+
+	result := &FetchResult{
+		Body:         resp.Body,
+		StatusCode:   resp.StatusCode,
+		FinalUrl:     resp.Request.URL.String(),
+		ContentType:  resp.Header.Get("Content-Type"),
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+		StartTime:    start,
+	}
+
+	if f.Cache != nil {
+		f.Stats.RecordCacheResult(CacheMiss)
+		result.CacheResult = CacheMiss
+		if CacheableResponse(resp) {
+			err := f.Cache.StoreBody(u, resp.Body)
+			resp.Body.Close()
+			if err != nil {
+				return nil, err
+			}
+			if err := f.Cache.Store(&CacheEntry{
+				Url:          u,
+				FinalUrl:     result.FinalUrl,
+				ContentType:  result.ContentType,
+				ETag:         result.ETag,
+				LastModified: result.LastModified,
+				Expires:      ExpiresAt(resp.Header, time.Now()),
+			}); err != nil {
+				log.Printf("Unable to cache %s: %s", u, err)
+			}
+			if result.Body, err = f.Cache.OpenBody(u); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return timeBody(result), nil
+}
+
+// send sends the request for u, authenticated, and conditional on entry and resume. A request rejected
+// with 401 Unauthorized is sent again once, if its credentials can be replaced with fresh ones.
+// cancel must be called once the response body is closed.
+func (f *HTTPFetcher) send(ctx context.Context, u string, entry *CacheEntry, resume resumeRange, resuming bool) (*http.Response, context.CancelFunc, error) {
+	var a Authenticator
+	if origin, err := OriginOf(u); err == nil {
+		a = f.Authenticators[origin]
+	}
+	for reauthenticated := false; ; reauthenticated = true {
+		// Cancelled once the response body is closed, or a read of it times out.
+		reqCtx, cancel := context.WithCancel(ctx)
+		req, err := http.NewRequestWithContext(reqCtx, http.MethodGet, u, nil)
+		if err != nil {
+			cancel()
+			return nil, nil, err
+		}
+		if a != nil {
+			if err := a.Authenticate(ctx, req); err != nil {
+				cancel()
+				return nil, nil, err
+			}
+			req = withCredentialHeaders(req)
+		}
+		if resuming {
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-", resume.offset))
+			req.Header.Set("If-Range", resume.ifRange)
+		}
+		if entry != nil {
+			if entry.ETag != "" {
+				req.Header.Set("If-None-Match", entry.ETag)
+			}
+			if entry.LastModified != "" {
+				req.Header.Set("If-Modified-Since", entry.LastModified)
+			}
+		}
+
+		resp, err := f.Client.Do(req)
+		if err != nil {
+			cancel()
+			return nil, nil, err
+		}
+		// The final request holds the rejected credentials, unless a redirect removed them.
+		invalidator, ok := a.(CredentialInvalidator)
+		if resp.StatusCode != http.StatusUnauthorized || reauthenticated || !ok || !invalidator.Invalidate(resp.Request) {
+			return resp, cancel, nil
+		}
+		resp.Body.Close()
+		cancel()
+	}
+}
+
+// openCachedBody opens the cached response body of u, subject to the same limit as network responses.
+func (f *HTTPFetcher) openCachedBody(u string, maxBytes int64) (io.ReadCloser, error) {
+	body, err := f.Cache.OpenBody(u)
+	if err != nil {
+		return nil, err
+	}
+	if maxBytes <= 0 {
+		return body, nil
+	}
+	if info, err := body.Stat(); err == nil && info.Size() > maxBytes {
+		body.Close()
+		return nil, &ResponseTooLargeError{Url: u, MaxBytes: maxBytes}
+	}
+	return &limitedBody{ReadCloser: body, url: u, maxBytes: maxBytes}, nil
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Manifest crawl modes recorded by CrawlStats.RecordManifestMode.
+const (
+	// The manifest and all of its leaf files were fetched.
+	ManifestModeFull = "full"
+	// The manifest was fetched with _since, and the changed leaf files were stored beside the previous snapshot's.
+	ManifestModeIncremental = "incremental"
+	// The manifest's transactionTime did not change, and the previous snapshot's leaf files were reused.
+	ManifestModeUnchanged = "unchanged"
+)
+
+// PreviousSnapshot is the output of a previous crawl, used to crawl incrementally.
+type PreviousSnapshot struct {
+	// The previous crawler output.
+	db *sql.DB
+
+	// Maps manifest URL -> the manifest's latest row in db.
+	manifests map[string]previousManifest
+}
+
+// previousManifest is a manifest crawled by a previous crawl.
+type previousManifest struct {
+	id              int64
+	transactionTime string
+}
+
+// FindPreviousOutput returns the latest existing file matching the crawler's output template,
+// or "" if there is none.
+func FindPreviousOutput(outputFilenameTemplate string) (string, error) {
+	files, err := FindOutputs(outputFilenameTemplate)
+	if err != nil || len(files) == 0 {
+		return "", err
+	}
+	return files[len(files)-1], nil
+}
+
+// FindOutputs returns the existing files matching the crawler's output template, oldest first.
+func FindOutputs(outputFilenameTemplate string) ([]string, error) {
+	files, err := filepath.Glob(strings.ReplaceAll(outputFilenameTemplate, "VERSION", "*"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// OpenPreviousSnapshot opens the previous crawler output filename.
+func OpenPreviousSnapshot(filename string) (*PreviousSnapshot, error) {
+	db, err := sql.Open("sqlite3", filename)
+	if err != nil {
+		return nil, err
+	}
+	p, err := LoadPreviousSnapshot(db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return p, nil
+}
+
+// LoadPreviousSnapshot loads the manifests crawled into db. If a manifest was crawled multiple
+// times, e.g. into a long-lived --database, the latest crawl is used.
+// Manifests whose transactionTime could not be parsed, or whose crawl was interrupted, are ignored.
+func LoadPreviousSnapshot(db *sql.DB) (*PreviousSnapshot, error) {
+	rows, err := db.Query(`
+      SELECT manifest_id, url, transaction_time FROM manifests
+      WHERE transaction_time IS NOT NULL AND crawl_end_ms IS NOT NULL
+      ORDER BY manifest_id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	p := &PreviousSnapshot{db: db, manifests: make(map[string]previousManifest)}
+	for rows.Next() {
+		var m previousManifest
+		var u string
+		if err := rows.Scan(&m.id, &u, &m.transactionTime); err != nil {
+			return nil, err
+		}
+		// Later rows override earlier ones.
+		p.manifests[u] = m
+	}
+	return p, rows.Err()
+}
+
+// Close closes the previous crawler output.
+func (p *PreviousSnapshot) Close() error {
+	return p.db.Close()
+}
+
+// TransactionTime returns the transactionTime of manifestUrl in the previous snapshot.
+func (p *PreviousSnapshot) TransactionTime(manifestUrl string) (string, bool) {
+	if p == nil {
+		return "", false
+	}
+	m, ok := p.manifests[manifestUrl]
+	return m.transactionTime, ok
+}
+
+// CopyLeafFiles copies manifestUrl's leaf files from the previous snapshot into output, under
+// crawl run runId and the new manifestId. Copies keep their fetch metadata, so their fetch_start_ms
+// is before the new manifest's. Files which were already copied, e.g. by the crawl run being resumed,
+// are skipped. Returns the number of copied files.
+func (p *PreviousSnapshot) CopyLeafFiles(manifestUrl string, output *sql.DB, runId, manifestId int64) (int, error) {
+	m, ok := p.manifests[manifestUrl]
+	if !ok {
+		return 0, nil
+	}
+
+	copied := 0
+	for _, table := range leafFileTables {
+		ids, err := p.leafFileIds(table, m.id)
+		if err != nil {
+			return copied, err
+		}
+		for _, id := range ids {
+			ok, err := p.copyLeafFile(table, id, output, runId, manifestId)
+			if err != nil {
+				return copied, err
+			}
+			if ok {
+				copied++
+			}
+		}
+	}
+	return copied, nil
+}
+
+// leafFileIds returns the primary keys of the leaf files in table belonging to manifestId.
+func (p *PreviousSnapshot) leafFileIds(table leafFileTable, manifestId int64) ([]int64, error) {
+	rows, err := p.db.Query(
+		fmt.Sprintf("SELECT %s FROM %s WHERE manifest_id = ?", table.StateJoinTableFK, table.FileTable),
+		manifestId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// copyLeafFile copies a single leaf file and its states. Returns false if the file was already copied.
+func (p *PreviousSnapshot) copyLeafFile(table leafFileTable, id int64, output *sql.DB, runId, manifestId int64) (bool, error) {
+	var u string
+	var r FetchResult
+	var c StoredContents
+	var contents, contentType, etag, lastModified, cacheResult sql.NullString
+	var startMs, durationMs int64
+	if err := p.db.QueryRow(
+		fmt.Sprintf(`
+      SELECT url, contents, storage, sha256, size_bytes, http_status, final_url, content_type, etag, last_modified,
+        fetch_start_ms, fetch_duration_ms, cache_result
+      FROM %s WHERE %s = ?`, table.FileTable, table.StateJoinTableFK), id).Scan(
+		&u, &contents, &c.Storage, &c.Sha256, &c.SizeBytes, &r.StatusCode, &r.FinalUrl, &contentType, &etag, &lastModified,
+		&startMs, &durationMs, &cacheResult); err != nil {
+		return false, err
+	}
+	var copies int
+	if err := output.QueryRow(
+		fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE manifest_id = ? AND url = ? AND fetch_start_ms = ?", table.FileTable),
+		manifestId, u, startMs).Scan(&copies); err != nil {
+		return false, err
+	}
+	if copies > 0 {
+		return false, nil
+	}
+	if contents.Valid {
+		c.Contents = &contents.String
+	}
+	r.ContentType = contentType.String
+	r.ETag = etag.String
+	r.LastModified = lastModified.String
+	r.CacheResult = cacheResult.String
+	r.StartTime = time.Unix(0, startMs*int64(time.Millisecond))
+	r.Duration = time.Duration(durationMs) * time.Millisecond
+
+	stateIds, err := p.leafFileStateIds(table, id)
+	if err != nil {
+		return false, err
+	}
+
+	newId, err := InsertFile(output, runId, table.FileTable, u, &r, &c, []string{"manifest_id"}, manifestId)
+	if err != nil {
+		return false, err
+	}
+	switch c.Storage {
+	case StorageLines:
+		if err := p.copyLines(table, id, output, newId); err != nil {
+			return false, err
+		}
+	case StorageBlob:
+		if err := p.copyBlob(c.Sha256, output); err != nil {
+			return false, err
+		}
+	}
+	for _, stateId := range stateIds {
+		if _, err := output.Exec(
+			fmt.Sprintf("INSERT INTO %s (%s, state_id) VALUES (?, ?)", table.StateJoinTable, table.StateJoinTableFK),
+			newId, stateId); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// copyBlob copies the blob with hash sha256 into output, unless output already has it.
+func (p *PreviousSnapshot) copyBlob(sha256 string, output *sql.DB) error {
+	var exists int
+	if err := output.QueryRow("SELECT COUNT(*) FROM blobs WHERE sha256 = ?", sha256).Scan(&exists); err != nil {
+		return err
+	}
+	if exists > 0 {
+		return nil
+	}
+
+	var compression string
+	var size int64
+	var data []byte
+	if err := p.db.QueryRow(
+		"SELECT compression, size_bytes, data FROM blobs WHERE sha256 = ?", sha256).Scan(&compression, &size, &data); err != nil {
+		return err
+	}
+	_, err := output.Exec(
+		"INSERT INTO blobs (sha256, compression, size_bytes, data) VALUES (?, ?, ?, ?)", sha256, compression, size, data)
+	return err
+}
+
+// copyLines copies the lines of leaf file id into output under newId, linesBatchSize lines at a time.
+// Each batch is read completely before it is written, since the previous snapshot may share
+// output's single connection.
+func (p *PreviousSnapshot) copyLines(table leafFileTable, id int64, output *sql.DB, newId int64) error {
+	w := &linesWriter{output: output, table: table, fileId: newId}
+	lastLineNumber := 0
+	for {
+		rows, err := p.db.Query(
+			fmt.Sprintf(`
+      SELECT line_number, contents FROM %s
+      WHERE %s = ? AND line_number > ?
+      ORDER BY line_number LIMIT ?`, table.LinesTable, table.StateJoinTableFK),
+			id, lastLineNumber, linesBatchSize)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var line string
+			if err := rows.Scan(&lastLineNumber, &line); err != nil {
+				rows.Close()
+				return err
+			}
+			w.lineNumbers = append(w.lineNumbers, lastLineNumber)
+			w.lines = append(w.lines, line)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		if len(w.lines) == 0 {
+			return nil
+		}
+		if err := w.flush(); err != nil {
+			return err
+		}
+	}
+}
+
+// leafFileStateIds returns the state ids joined with the leaf file id in table.
+func (p *PreviousSnapshot) leafFileStateIds(table leafFileTable, id int64) ([]int64, error) {
+	rows, err := p.db.Query(
+		fmt.Sprintf("SELECT state_id FROM %s WHERE %s = ?", table.StateJoinTable, table.StateJoinTableFK), id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// WithSince returns manifestUrl with the `_since` query parameter set to since.
+func WithSince(manifestUrl, since string) (string, error) {
+	u, err := url.Parse(manifestUrl)
+	if err != nil {
+		return "", err
+	}
+	q := u.Query()
+	q.Set("_since", since)
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ManifestFileName is the name of manifest files in directories and archives.
+const ManifestFileName = "$bulk-publish"
+
+// LocalFetcher fetches file:// URLs from the local filesystem, e.g. to crawl offline or to ingest a
+// snapshot of a publisher's files. URLs may name:
+//   - A file, e.g. file:///data/cvs/$bulk-publish.
+//   - A directory, in which case its $bulk-publish file is fetched, e.g. file:///data/cvs/.
+//   - A .tar.gz, .tgz, or .zip archive, in which case its shallowest $bulk-publish file is fetched,
+//     e.g. file:///data/cvs.zip.
+//   - A file in an archive, e.g. file:///data/cvs.zip/slots/ma.ndjson.
+//
+// FetchResult.FinalUrl names the file which was fetched, so that relative URLs in a manifest resolve
+// to files next to it. Thread safe.
+type LocalFetcher struct{}
+
+// Wrap returns a FetcherFn which fetches file:// URLs with f, and all other URLs with fetchFn.
+func (f *LocalFetcher) Wrap(fetchFn FetcherFn) FetcherFn {
+	return func(ctx context.Context, u string) (*FetchResult, error) {
+		if IsLocalUrl(u) {
+			return f.Fetch(ctx, u)
+		}
+		return fetchFn(ctx, u)
+	}
+}
+
+// IsLocalUrl returns whether u is a file:// URL.
+func IsLocalUrl(u string) bool {
+	parsed, err := url.Parse(u)
+	return err == nil && strings.EqualFold(parsed.Scheme, "file")
+}
+
+// ResolveUrl resolves ref, which may be relative, e.g. in a local manifest, against base. Returns ref if either is malformed.
+func ResolveUrl(base, ref string) string {
+	b, err := url.Parse(base)
+	if err != nil {
+		return ref
+	}
+	r, err := url.Parse(ref)
+	if err != nil {
+		return ref
+	}
+	return b.ResolveReference(r).String()
+}
+
+// Fetch implements FetcherFn.
+// Files larger than the limit set on ctx by WithMaxResponseBytes fail with *ResponseTooLargeError.
+func (f *LocalFetcher) Fetch(ctx context.Context, u string) (*FetchResult, error) {
+	start := time.Now()
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return nil, err
+	}
+	if parsed.Host != "" && parsed.Host != "localhost" {
+		return nil, fmt.Errorf("file URL %s must not have a host", u)
+	}
+	p := filepath.FromSlash(parsed.Path)
+
+	var body io.ReadCloser
+	var finalPath string
+	var info os.FileInfo
+	if info, err = os.Stat(p); err == nil {
+		switch {
+		case info.IsDir():
+			finalPath = filepath.Join(p, ManifestFileName)
+			if info, err = os.Stat(finalPath); err != nil {
+				return nil, err
+			}
+			if body, err = os.Open(finalPath); err != nil {
+				return nil, err
+			}
+		case isArchive(p):
+			member, err := findArchiveManifest(p)
+			if err != nil {
+				return nil, err
+			}
+			finalPath = filepath.Join(p, filepath.FromSlash(member))
+			if body, err = openArchiveMember(p, member); err != nil {
+				return nil, err
+			}
+		default:
+			finalPath = p
+			if body, err = os.Open(p); err != nil {
+				return nil, err
+			}
+		}
+	} else {
+		// p does not exist, or a parent of p is a file, e.g. an archive.
+		archive, member, ok := splitArchivePath(p)
+		if !ok {
+			return nil, err
+		}
+		finalPath = p
+		if info, err = os.Stat(archive); err != nil {
+			return nil, err
+		}
+		if body, err = openArchiveMember(archive, member); err != nil {
+			return nil, err
+		}
+	}
+
+	if maxBytes := responseByteLimit(ctx); maxBytes > 0 {
+		body = &limitedBody{ReadCloser: body, url: u, maxBytes: maxBytes}
+	}
+	final := url.URL{Scheme: "file", Path: filepath.ToSlash(finalPath)}
+	return timeBody(&FetchResult{
+		Body:         body,
+		StatusCode:   http.StatusOK,
+		FinalUrl:     final.String(),
+		LastModified: info.ModTime().UTC().Format(http.TimeFormat),
+		StartTime:    start,
+	}), nil
+}
+
+// isArchive returns whether p names a supported archive.
+func isArchive(p string) bool {
+	for _, suffix := range []string{".tar.gz", ".tgz", ".zip"} {
+		if strings.HasSuffix(strings.ToLower(p), suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// splitArchivePath splits p, which names a file in an archive, into the archive's path and the
+// member's slash separated name. Returns false if no parent of p is an archive.
+func splitArchivePath(p string) (string, string, bool) {
+	member := ""
+	for dir := p; ; {
+		parent, base := filepath.Split(filepath.Clean(dir))
+		if base == "" || parent == dir {
+			return "", "", false
+		}
+		member = path.Join(base, member)
+		dir = filepath.Clean(parent)
+		if isArchive(dir) {
+			if info, err := os.Stat(dir); err == nil && info.Mode().IsRegular() {
+				return dir, member, true
+			}
+		}
+	}
+}
+
+// normalizeMember returns the slash separated name of an archive member without a leading "./".
+func normalizeMember(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+// findArchiveManifest returns the name of the shallowest $bulk-publish file in archive.
+func findArchiveManifest(archive string) (string, error) {
+	var names []string
+	if strings.HasSuffix(strings.ToLower(archive), ".zip") {
+		z, err := zip.OpenReader(archive)
+		if err != nil {
+			return "", err
+		}
+		defer z.Close()
+		for _, f := range z.File {
+			names = append(names, f.Name)
+		}
+	} else {
+		var err error
+		if names, err = listTarGz(archive); err != nil {
+			return "", err
+		}
+	}
+
+	manifest := ""
+	for _, name := range names {
+		name = normalizeMember(name)
+		if path.Base(name) != ManifestFileName {
+			continue
+		}
+		if manifest == "" || strings.Count(name, "/") < strings.Count(manifest, "/") {
+			manifest = name
+		}
+	}
+	if manifest == "" {
+		return "", fmt.Errorf("no %s file in archive %s", ManifestFileName, archive)
+	}
+	return manifest, nil
+}
+
+// openArchiveMember opens member of archive. The returned body closes the archive.
+func openArchiveMember(archive, member string) (io.ReadCloser, error) {
+	if strings.HasSuffix(strings.ToLower(archive), ".zip") {
+		z, err := zip.OpenReader(archive)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range z.File {
+			if normalizeMember(f.Name) != member {
+				continue
+			}
+			r, err := f.Open()
+			if err != nil {
+				z.Close()
+				return nil, err
+			}
+			return &archiveMemberBody{Reader: r, closers: []io.Closer{r, z}}, nil
+		}
+		z.Close()
+		return nil, &os.PathError{Op: "open", Path: path.Join(filepath.ToSlash(archive), member), Err: os.ErrNotExist}
+	}
+
+	file, err := os.Open(archive)
+	if err != nil {
+		return nil, err
+	}
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	tr := tar.NewReader(gz)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			gz.Close()
+			file.Close()
+			return nil, err
+		}
+		if h.Typeflag == tar.TypeReg && normalizeMember(h.Name) == member {
+			return &archiveMemberBody{Reader: tr, closers: []io.Closer{gz, file}}, nil
+		}
+	}
+	gz.Close()
+	file.Close()
+	return nil, fmt.Errorf("no file %s in archive %s", member, archive)
+}
+
+// listTarGz returns the names of the regular files in the .tar.gz archive.
+func listTarGz(archive string) ([]string, error) {
+	file, err := os.Open(archive)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+	var names []string
+	tr := tar.NewReader(gz)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return names, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if h.Typeflag == tar.TypeReg {
+			names = append(names, h.Name)
+		}
+	}
+}
+
+// archiveMemberBody is the body of a file read from an archive.
+type archiveMemberBody struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (b *archiveMemberBody) Close() error {
+	var err error
+	for _, c := range b.closers {
+		if cerr := c.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+)
+
+// blockedNetworks are the address ranges URLPolicy rejects unless AllowPrivateAddresses is set:
+// private, shared, loopback, link-local (including cloud metadata endpoints), unspecified, IETF protocol
+// assignment, benchmarking, and reserved addresses, and NAT64 prefixes, which can map to any of them.
+var blockedNetworks = mustParseCIDRs(
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.0.0.0/24",
+	"192.168.0.0/16",
+	"198.18.0.0/15",
+	"240.0.0.0/4",
+	"::/128",
+	"::1/128",
+	"64:ff9b::/96",
+	"64:ff9b:1::/48",
+	"fc00::/7",
+	"fe80::/10",
+)
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	var networks []*net.IPNet
+	for _, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks = append(networks, n)
+	}
+	return networks
+}
+
+// PolicyError is returned when a URL is rejected by the URLPolicy.
+type PolicyError struct {
+	Url    string
+	Reason string
+}
+
+func (e *PolicyError) Error() string {
+	return fmt.Sprintf("%s rejected by URL policy: %s", e.Url, e.Reason)
+}
+
+// URLPolicy restricts which URLs the crawler fetches, so that manifests cannot direct the crawler
+// at internal services.
+//
+// Only http and https URLs are fetched. Host names are checked after DNS resolution by the dialer
+// (see DialControl), so that a host name cannot pass the check and then resolve to a blocked address.
+type URLPolicy struct {
+	// Whether URLs may point at private, loopback, link-local, or unspecified addresses.
+	AllowPrivateAddresses bool
+
+	// The maximum number of redirects followed per request. Negative values disable redirects.
+	MaxRedirects int
+
+	// Whether host names are resolved and checked by Check. Requests sent through a proxy are
+	// resolved by the proxy, so the dialer cannot check them.
+	ResolveHosts bool
+}
+
+// Check returns a *PolicyError if u may not be fetched.
+func (p *URLPolicy) Check(ctx context.Context, u string) error {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return &PolicyError{Url: u, Reason: "malformed URL"}
+	}
+	if parsed.Scheme != "http" && parsed.Scheme != "https" {
+		return &PolicyError{Url: u, Reason: fmt.Sprintf("scheme '%s' is not http or https", parsed.Scheme)}
+	}
+	host := parsed.Hostname()
+	if host == "" {
+		return &PolicyError{Url: u, Reason: "no host"}
+	}
+	if p.AllowPrivateAddresses {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return p.checkIP(u, ip)
+	}
+	if strings.EqualFold(host, "localhost") || strings.HasSuffix(strings.ToLower(host), ".localhost") {
+		return &PolicyError{Url: u, Reason: "host is loopback"}
+	}
+	if p.ResolveHosts {
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return err
+		}
+		for _, addr := range addrs {
+			if err := p.checkIP(u, addr.IP); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// checkIP returns a *PolicyError if ip is in a blocked network. u is the URL being fetched.
+func (p *URLPolicy) checkIP(u string, ip net.IP) error {
+	if p.AllowPrivateAddresses {
+		return nil
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	if ip.IsMulticast() {
+		return &PolicyError{Url: u, Reason: fmt.Sprintf("address %s is multicast", ip)}
+	}
+	for _, n := range blockedNetworks {
+		if n.Contains(ip) {
+			return &PolicyError{Url: u, Reason: fmt.Sprintf("address %s is in blocked network %s", ip, n)}
+		}
+	}
+	return nil
+}
+
+// DialControl implements net.Dialer.Control, rejecting connections to blocked addresses.
+// exempt contains the "ip:port" addresses which are always allowed, i.e. those of the proxy.
+func (p *URLPolicy) DialControl(exempt map[string]bool) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		if exempt[address] {
+			return nil
+		}
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return err
+		}
+		ip := net.ParseIP(host)
+		if ip == nil {
+			return &PolicyError{Url: address, Reason: "unresolved address"}
+		}
+		return p.checkIP(address, ip)
+	}
+}
+
+// CheckRedirect implements http.Client.CheckRedirect, limiting the number of redirects and
+// checking each redirect's URL. Publisher credentials are removed from redirects to other origins,
+// see StripCredentials.
+func (p *URLPolicy) CheckRedirect(req *http.Request, via []*http.Request) error {
+	StripCredentials(req, via)
+	if len(via) > p.MaxRedirects {
+		return &PolicyError{Url: req.URL.String(), Reason: fmt.Sprintf("more than %d redirects", p.MaxRedirects)}
+	}
+	return p.Check(req.Context(), req.URL.String())
+}
+
+// Wrap returns a FetcherFn which only calls fetchFn for URLs allowed by the policy.
+func (p *URLPolicy) Wrap(fetchFn FetcherFn) FetcherFn {
+	return func(ctx context.Context, u string) (*FetchResult, error) {
+		if err := p.Check(ctx, u); err != nil {
+			return nil, err
+		}
+		return fetchFn(ctx, u)
+	}
+}
+
+// CheckLocalLeafFile returns a *PolicyError if leafUrl is a file:// URL but manifestUrl is not, so that
+// publishers cannot read the crawler's local files.
+func CheckLocalLeafFile(manifestUrl, leafUrl string) error {
+	if IsLocalUrl(leafUrl) && !IsLocalUrl(manifestUrl) {
+		return &PolicyError{Url: leafUrl, Reason: "local files may only be listed by local manifests"}
+	}
+	return nil
+}
+
+// CheckSameOrigin returns a *PolicyError if leafUrl's origin differs from manifestUrl's.
+// Local files listed by local manifests are always allowed.
+func CheckSameOrigin(manifestUrl, leafUrl string) error {
+	if IsLocalUrl(manifestUrl) && IsLocalUrl(leafUrl) {
+		return nil
+	}
+	manifestOrigin, err := OriginOf(manifestUrl)
+	if err != nil {
+		return err
+	}
+	leafOrigin, err := OriginOf(leafUrl)
+	if err != nil {
+		return &PolicyError{Url: leafUrl, Reason: "malformed URL"}
+	}
+	if leafOrigin != manifestOrigin {
+		return &PolicyError{Url: leafUrl, Reason: fmt.Sprintf("origin differs from the manifest's origin %s", manifestOrigin)}
+	}
+	return nil
+}
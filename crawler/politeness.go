@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HostLimits are the politeness limits applied to requests made to a single host.
+type HostLimits struct {
+	// The maximum number of requests per second. Values <= 0 disable rate limiting.
+	QPS float64
+
+	// The maximum number of in-flight requests. Values <= 0 disable the cap.
+	MaxInFlight int
+}
+
+// HostPolicy enforces per-host request rates and in-flight request caps.
+// Thread safe.
+type HostPolicy struct {
+	// Limits applied to hosts without an entry in Overrides.
+	Default HostLimits
+
+	// Maps host (as in url.URL.Host, including any port) -> limits.
+	Overrides map[string]HostLimits
+
+	// Maps host -> limiter. Lazily populated.
+	limiters map[string]*hostLimiter
+
+	// Guards limiters.
+	mu sync.Mutex
+}
+
+// hostLimiter limits requests to a single host.
+type hostLimiter struct {
+	// Buffered channel with MaxInFlight capacity. nil if in-flight requests are not capped.
+	inFlight chan struct{}
+
+	// The minimum interval between request starts. 0 if requests are not rate limited.
+	interval time.Duration
+
+	// The earliest time the next request may start.
+	next time.Time
+
+	// Guards next.
+	mu sync.Mutex
+}
+
+func newHostLimiter(l HostLimits) *hostLimiter {
+	h := &hostLimiter{}
+	if l.MaxInFlight > 0 {
+		h.inFlight = make(chan struct{}, l.MaxInFlight)
+	}
+	if l.QPS > 0 {
+		h.interval = time.Duration(float64(time.Second) / l.QPS)
+	}
+	return h
+}
+
+// acquire blocks until a request may be issued to the host, or ctx is done.
+// release must be called if and only if acquire returns nil.
+func (h *hostLimiter) acquire(ctx context.Context) error {
+	if h.inFlight != nil {
+		select {
+		case h.inFlight <- struct{}{}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	if h.interval == 0 {
+		return nil
+	}
+
+	h.mu.Lock()
+	now := time.Now()
+	if h.next.Before(now) {
+		h.next = now
+	}
+	wait := h.next.Sub(now)
+	h.next = h.next.Add(h.interval)
+	h.mu.Unlock()
+
+	t := time.NewTimer(wait)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		h.release()
+		return ctx.Err()
+	}
+}
+
+// release marks a request to the host as finished.
+func (h *hostLimiter) release() {
+	if h.inFlight != nil {
+		<-h.inFlight
+	}
+}
+
+// limiter returns the limiter for host, creating it if needed.
+func (p *HostPolicy) limiter(host string) *hostLimiter {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.limiters == nil {
+		p.limiters = make(map[string]*hostLimiter)
+	}
+	if l, ok := p.limiters[host]; ok {
+		return l
+	}
+
+	limits, ok := p.Overrides[host]
+	if !ok {
+		limits = p.Default
+	}
+	l := newHostLimiter(limits)
+	p.limiters[host] = l
+	return l
+}
+
+// Wrap returns a FetcherFn that applies the policy to every call to fetchFn.
+// A request is in flight until the returned body is closed.
+// URLs that cannot be parsed are passed through to fetchFn unlimited.
+func (p *HostPolicy) Wrap(fetchFn FetcherFn) FetcherFn {
+	return func(ctx context.Context, u string) (*FetchResult, error) {
+		host, err := HostOf(u)
+		if err != nil {
+			return fetchFn(ctx, u)
+		}
+
+		l := p.limiter(host)
+		if err := l.acquire(ctx); err != nil {
+			return nil, err
+		}
+		result, err := fetchFn(ctx, u)
+		if err != nil {
+			l.release()
+			return nil, err
+		}
+		return releaseOnClose(result, l.release), nil
+	}
+}
+
+// HostOf returns the host (including any port) of URL u.
+func HostOf(u string) (string, error) {
+	ur, err := url.Parse(u)
+	if err != nil {
+		return "", err
+	}
+	return ur.Host, nil
+}
+
+// ParseHostOverrides parses a comma separated list of per-host limits of the form
+// "HOST=QPS:MAX_IN_FLIGHT", e.g. "www.cvs.com=0.5:1,api.carbonhealth.com=5:4".
+// Either QPS or MAX_IN_FLIGHT may be empty, in which case the default from defaults is used.
+func ParseHostOverrides(s string, defaults HostLimits) (map[string]HostLimits, error) {
+	overrides := make(map[string]HostLimits)
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("malformed host override '%s': expected HOST=QPS:MAX_IN_FLIGHT", entry)
+		}
+		limitParts := strings.SplitN(parts[1], ":", 2)
+		if len(limitParts) != 2 {
+			return nil, fmt.Errorf("malformed host override '%s': expected HOST=QPS:MAX_IN_FLIGHT", entry)
+		}
+
+		limits := defaults
+		if limitParts[0] != "" {
+			qps, err := strconv.ParseFloat(limitParts[0], 64)
+			if err != nil {
+				return nil, fmt.Errorf("malformed QPS in host override '%s': %s", entry, err)
+			}
+			limits.QPS = qps
+		}
+		if limitParts[1] != "" {
+			maxInFlight, err := strconv.Atoi(limitParts[1])
+			if err != nil {
+				return nil, fmt.Errorf("malformed max in-flight in host override '%s': %s", entry, err)
+			}
+			limits.MaxInFlight = maxInFlight
+		}
+		overrides[parts[0]] = limits
+	}
+	return overrides, nil
+}
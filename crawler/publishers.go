@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+)
+
+// PublisherRegistry is the list of Slot Publishers crawled by the crawler, loaded from --publishers.
+//
+// Example:
+//
+//	{
+//	  "publishers": [
+//	    {
+//	      "name": "CVS",
+//	      "manifest_url": "https://www.cvs.com/immunizations/inventory/data/$bulk-publish",
+//	      "rate_limit": {"qps": 0.5, "max_in_flight": 1},
+//	      "expected_states": ["MA", "CA"],
+//	      "contact": {"name": "CVS Scheduling", "email": "scheduling@example.com"}
+//	    }
+//	  ]
+//	}
+type PublisherRegistry struct {
+	Publishers []*Publisher `json:"publishers"`
+}
+
+// Publisher is a Slot Publisher in the PublisherRegistry.
+type Publisher struct {
+	// A unique, human readable name, e.g. "CVS".
+	Name string `json:"name"`
+
+	// The URL of the publisher's manifest file.
+	ManifestUrl string `json:"manifest_url"`
+
+	// Whether the publisher is crawled. Defaults to true.
+	Enabled *bool `json:"enabled,omitempty"`
+
+	// Politeness limits for the manifest URL's host. nil uses --host_max_qps and --host_max_in_flight.
+	RateLimit *PublisherRateLimit `json:"rate_limit,omitempty"`
+
+	// How requests to the publisher are authenticated. nil if the publisher is public.
+	// Credentials are only sent to the manifest URL's origin, and are removed from redirects to other origins.
+	Auth *PublisherAuth `json:"auth,omitempty"`
+
+	// Two character names of the states the publisher is expected to publish slots for, e.g. "MA".
+	ExpectedStates []string `json:"expected_states,omitempty"`
+
+	// Who to contact about the publisher's data.
+	Contact *PublisherContact `json:"contact,omitempty"`
+}
+
+// PublisherRateLimit overrides the politeness limits of a publisher's host. Unset fields use the defaults.
+type PublisherRateLimit struct {
+	// See HostLimits.QPS.
+	QPS *float64 `json:"qps,omitempty"`
+
+	// See HostLimits.MaxInFlight.
+	MaxInFlight *int `json:"max_in_flight,omitempty"`
+}
+
+// PublisherContact is who to contact about a publisher's data.
+type PublisherContact struct {
+	Name  string `json:"name,omitempty"`
+	Email string `json:"email,omitempty"`
+	Url   string `json:"url,omitempty"`
+}
+
+// IsEnabled returns whether the publisher is crawled.
+func (p *Publisher) IsEnabled() bool {
+	return p.Enabled == nil || *p.Enabled
+}
+
+// Limits returns the publisher's politeness limits, falling back to defaults for unset limits.
+func (r *PublisherRateLimit) Limits(defaults HostLimits) HostLimits {
+	limits := defaults
+	if r.QPS != nil {
+		limits.QPS = *r.QPS
+	}
+	if r.MaxInFlight != nil {
+		limits.MaxInFlight = *r.MaxInFlight
+	}
+	return limits
+}
+
+// LoadPublisherRegistry reads and validates the publisher registry in filename.
+// Unknown fields are rejected, so that misspelled settings are not silently ignored.
+func LoadPublisherRegistry(filename string) (*PublisherRegistry, error) {
+	c, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	d := json.NewDecoder(bytes.NewReader(c))
+	d.DisallowUnknownFields()
+	var r PublisherRegistry
+	if err := d.Decode(&r); err != nil {
+		return nil, fmt.Errorf("malformed publisher registry %s: %s", filename, err)
+	}
+	if err := r.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid publisher registry %s: %s", filename, err)
+	}
+	return &r, nil
+}
+
+// PublisherRegistryFromManifestUrls returns a registry of enabled publishers named by their manifest URLs.
+func PublisherRegistryFromManifestUrls(urls []string) *PublisherRegistry {
+	r := &PublisherRegistry{}
+	for _, u := range urls {
+		r.Publishers = append(r.Publishers, &Publisher{Name: u, ManifestUrl: u})
+	}
+	return r
+}
+
+// Validate checks that publishers have unique names and manifest URLs, and valid settings.
+func (r *PublisherRegistry) Validate() error {
+	names := make(map[string]bool)
+	manifestUrls := make(map[string]bool)
+	for i, p := range r.Publishers {
+		if p.Name == "" {
+			return fmt.Errorf("publisher %d has no name", i)
+		}
+		if names[p.Name] {
+			return fmt.Errorf("duplicate publisher name '%s'", p.Name)
+		}
+		names[p.Name] = true
+
+		if _, err := url.Parse(p.ManifestUrl); p.ManifestUrl == "" || err != nil {
+			return fmt.Errorf("publisher '%s' has a malformed manifest_url '%s'", p.Name, p.ManifestUrl)
+		}
+		if manifestUrls[p.ManifestUrl] {
+			return fmt.Errorf("duplicate manifest_url '%s' in publisher '%s'", p.ManifestUrl, p.Name)
+		}
+		manifestUrls[p.ManifestUrl] = true
+
+		if p.Auth != nil {
+			if err := p.Auth.Validate(); err != nil {
+				return fmt.Errorf("publisher '%s': %s", p.Name, err)
+			}
+		}
+		for _, state := range p.ExpectedStates {
+			if _, ok := StateById[strings.ToUpper(state)]; !ok {
+				return fmt.Errorf("publisher '%s' expects unknown state '%s'", p.Name, state)
+			}
+		}
+	}
+	return nil
+}
+
+// Enabled returns the publishers which are crawled.
+func (r *PublisherRegistry) Enabled() []*Publisher {
+	var enabled []*Publisher
+	for _, p := range r.Publishers {
+		if p.IsEnabled() {
+			enabled = append(enabled, p)
+		}
+	}
+	return enabled
+}
+
+// HostOverrides returns the politeness limits of the manifest hosts of enabled publishers with a
+// rate_limit, keyed by host. Publishers sharing a host must have the same limits.
+func (r *PublisherRegistry) HostOverrides(defaults HostLimits) (map[string]HostLimits, error) {
+	overrides := make(map[string]HostLimits)
+	// Maps host -> the name of the publisher its limits came from.
+	hostToPublisher := make(map[string]string)
+	for _, p := range r.Enabled() {
+		if p.RateLimit == nil {
+			continue
+		}
+		host, err := HostOf(p.ManifestUrl)
+		if err != nil {
+			return nil, err
+		}
+		limits := p.RateLimit.Limits(defaults)
+		if other, ok := hostToPublisher[host]; ok && overrides[host] != limits {
+			return nil, fmt.Errorf("publishers '%s' and '%s' share host %s but have different rate limits", other, p.Name, host)
+		}
+		overrides[host] = limits
+		hostToPublisher[host] = p.Name
+	}
+	return overrides, nil
+}
+
+// Authenticators returns the Authenticators of enabled publishers with auth, keyed by the origin of
+// their manifest URLs. Publishers sharing an origin must have the same auth.
+// client is used to request access tokens.
+func (r *PublisherRegistry) Authenticators(client *http.Client) (map[string]Authenticator, error) {
+	authenticators := make(map[string]Authenticator)
+	// Maps origin -> the publisher its Authenticator came from.
+	originToPublisher := make(map[string]*Publisher)
+	for _, p := range r.Enabled() {
+		if p.Auth == nil {
+			continue
+		}
+		origin, err := OriginOf(p.ManifestUrl)
+		if err != nil {
+			return nil, err
+		}
+		if other, ok := originToPublisher[origin]; ok {
+			if !reflect.DeepEqual(other.Auth, p.Auth) {
+				return nil, fmt.Errorf("publishers '%s' and '%s' share origin %s but have different auth", other.Name, p.Name, origin)
+			}
+			continue
+		}
+		a, err := NewAuthenticator(p.Auth, client)
+		if err != nil {
+			return nil, fmt.Errorf("cannot set up auth for publisher '%s': %s", p.Name, err)
+		}
+		authenticators[origin] = a
+		originToPublisher[origin] = p
+	}
+	return authenticators, nil
+}
+
+// RecordPublishers records the registry's publishers into output under crawl run runId, unless a
+// publisher with the same name was already recorded, e.g. by the crawl run being resumed.
+// Returns the publisher_id of every publisher, keyed by manifest URL.
+func RecordPublishers(output *sql.DB, runId int64, r *PublisherRegistry) (map[string]int64, error) {
+	// Maps name -> publisher_id.
+	recorded := make(map[string]int64)
+	rows, err := output.Query("SELECT publisher_id, name FROM publishers WHERE crawl_run_id = ?", runId)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var id int64
+		var name string
+		if err := rows.Scan(&id, &name); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		recorded[name] = id
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	ids := make(map[string]int64)
+	for _, p := range r.Publishers {
+		id, ok := recorded[p.Name]
+		if !ok {
+			config, err := json.Marshal(p)
+			if err != nil {
+				return nil, err
+			}
+			res, err := output.Exec(
+				"INSERT INTO publishers (crawl_run_id, name, manifest_url, enabled, config) VALUES (?, ?, ?, ?, ?)",
+				runId, p.Name, p.ManifestUrl, p.IsEnabled(), string(config))
+			if err != nil {
+				return nil, err
+			}
+			if id, err = res.LastInsertId(); err != nil {
+				return nil, err
+			}
+		}
+		ids[p.ManifestUrl] = id
+	}
+	return ids, nil
+}
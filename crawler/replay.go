@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"time"
+)
+
+// Fixture is the recorded result of fetching a URL.
+type Fixture struct {
+	// The requested URL.
+	Url string `json:"url"`
+
+	// The result of a successful fetch. See FetchResult. The body is stored next to the fixture.
+	StatusCode   int    `json:"status_code,omitempty"`
+	FinalUrl     string `json:"final_url,omitempty"`
+	ContentType  string `json:"content_type,omitempty"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+
+	// The error the fetch failed with. nil if the fetch succeeded.
+	Error *FixtureError `json:"error,omitempty"`
+}
+
+// FixtureError is a recorded fetch error.
+type FixtureError struct {
+	// The error's class. See ErrorClass.
+	Class string `json:"class"`
+
+	// The error's message, excluding the number of attempts.
+	Message string `json:"message"`
+
+	// The HTTP status code, if the fetch failed with an *HTTPStatusError.
+	StatusCode int `json:"status_code,omitempty"`
+
+	// The number of attempts made, if the fetch failed with a *FetchError.
+	Attempts int `json:"attempts,omitempty"`
+}
+
+// ReplayedError is a recorded fetch error returned by FixtureArchive.Replay.
+// ErrorClass classifies it as the original error was classified.
+type ReplayedError struct {
+	Url     string
+	Class   string
+	Message string
+}
+
+func (e *ReplayedError) Error() string {
+	return e.Message
+}
+
+// FixtureArchive is a directory of recorded fetches, used to crawl deterministically and without
+// network access. Fixtures are stored like DiskCache entries: a JSON Fixture and a body per URL.
+// Safe to use from multiple goroutines.
+type FixtureArchive struct {
+	// Directory the fixtures are written to. Created if it doesn't exist.
+	Dir string
+}
+
+func (a *FixtureArchive) files() *DiskCache {
+	return &DiskCache{Dir: a.Dir}
+}
+
+// Record returns a FetcherFn which records the result of every fetch by fetchFn into the archive.
+// Response bodies are read fully into the archive before being returned.
+func (a *FixtureArchive) Record(fetchFn FetcherFn) FetcherFn {
+	return func(ctx context.Context, u string) (*FetchResult, error) {
+		result, err := fetchFn(ctx, u)
+		if err != nil {
+			// Cancelled fetches are not a result of the crawl, and are replayed by --resume instead.
+			if ctx.Err() == nil {
+				a.store(&Fixture{Url: u, Error: newFixtureError(err)})
+			}
+			return nil, err
+		}
+		files := a.files()
+		err = files.StoreBody(u, result.Body)
+		result.Body.Close()
+		if err != nil {
+			if ctx.Err() == nil {
+				a.store(&Fixture{Url: u, Error: newFixtureError(err)})
+			}
+			return nil, err
+		}
+		a.store(&Fixture{
+			Url:          u,
+			StatusCode:   result.StatusCode,
+			FinalUrl:     result.FinalUrl,
+			ContentType:  result.ContentType,
+			ETag:         result.ETag,
+			LastModified: result.LastModified,
+		})
+		if result.Body, err = files.OpenBody(u); err != nil {
+			return nil, err
+		}
+		return result, nil
+	}
+}
+
+// newFixtureError returns the recorded form of err.
+func newFixtureError(err error) *FixtureError {
+	f := &FixtureError{Class: ErrorClass(err), Message: err.Error()}
+	var fetchErr *FetchError
+	if errors.As(err, &fetchErr) {
+		f.Attempts = fetchErr.Attempts
+		f.Message = fetchErr.Err.Error()
+	}
+	var statusErr *HTTPStatusError
+	if errors.As(err, &statusErr) {
+		f.StatusCode = statusErr.StatusCode
+	}
+	return f
+}
+
+// store writes f into the archive. Failures are logged rather than failing the crawl.
+func (a *FixtureArchive) store(f *Fixture) {
+	files := a.files()
+	c, err := json.Marshal(f)
+	if err == nil {
+		err = files.writeFileAtomic(files.path(f.Url, ".json"), bytes.NewReader(c))
+	}
+	if err != nil {
+		log.Printf("Unable to record fixture for %s: %s", f.Url, err)
+	}
+}
+
+// Replay implements FetcherFn, serving every URL from the archive. Recorded errors are returned as
+// *HTTPStatusError or *ReplayedError, wrapped in a *FetchError if the original was.
+// URLs which were not recorded fail.
+func (a *FixtureArchive) Replay(ctx context.Context, u string) (*FetchResult, error) {
+	start := time.Now()
+	files := a.files()
+	c, err := ioutil.ReadFile(files.path(u, ".json"))
+	if err != nil {
+		return nil, fmt.Errorf("no fixture for %s in %s: %s", u, a.Dir, err)
+	}
+	var f Fixture
+	if err := json.Unmarshal(c, &f); err != nil {
+		return nil, fmt.Errorf("malformed fixture for %s in %s: %s", u, a.Dir, err)
+	}
+
+	if f.Error != nil {
+		var err error
+		if f.Error.StatusCode != 0 {
+			err = &HTTPStatusError{Url: u, StatusCode: f.Error.StatusCode}
+		} else {
+			err = &ReplayedError{Url: u, Class: f.Error.Class, Message: f.Error.Message}
+		}
+		if f.Error.Attempts > 0 {
+			err = &FetchError{Url: u, Attempts: f.Error.Attempts, Err: err}
+		}
+		return nil, err
+	}
+
+	body, err := files.OpenBody(u)
+	if err != nil {
+		return nil, err
+	}
+	return timeBody(&FetchResult{
+		Body:         body,
+		StatusCode:   f.StatusCode,
+		FinalUrl:     f.FinalUrl,
+		ContentType:  f.ContentType,
+		ETag:         f.ETag,
+		LastModified: f.LastModified,
+		StartTime:    start,
+	}), nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// testdata/replay was recorded with --record_fixtures by crawling http://publisher.example/$bulk-publish
+// through a local server acting as the publisher's proxy. The manifest lists a Location, a Schedule, and
+// three Slot files, of which slots-missing.ndjson responded 404, and slots-unavailable.ndjson responded
+// 503 to both of its --max_attempts=2 attempts.
+const replayManifestUrl = "http://publisher.example/$bulk-publish"
+
+// setFlags sets the crawler's flags for the duration of the test.
+func setFlags(t *testing.T, values map[string]string) {
+	for name, value := range values {
+		f := flag.Lookup(name)
+		if f == nil {
+			t.Fatalf("unknown flag --%s", name)
+		}
+		previous := f.Value.String()
+		if err := flag.Set(name, value); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { flag.Set(name, previous) })
+	}
+}
+
+// countRows returns the number of rows of table matching where.
+func countRows(t *testing.T, db *sql.DB, table, where string) int {
+	var n int
+	if err := db.QueryRow("SELECT COUNT(*) FROM " + table + " WHERE " + where).Scan(&n); err != nil {
+		t.Fatalf("counting %s: %s", table, err)
+	}
+	return n
+}
+
+func TestReplayFixtures(t *testing.T) {
+	for _, mode := range []string{StorageContents, StorageLines, StorageBlob} {
+		t.Run(mode, func(t *testing.T) {
+			dir := t.TempDir()
+			manifestUrlsFile := filepath.Join(dir, "manifest_urls")
+			if err := ioutil.WriteFile(manifestUrlsFile, []byte(replayManifestUrl+"\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			outputFile := filepath.Join(dir, "crawler_output.sqlite")
+			setFlags(t, map[string]string{
+				"publishers":      "",
+				"manifest_urls":   manifestUrlsFile,
+				"replay_fixtures": "testdata/replay",
+				"output":          outputFile,
+				"latest":          "",
+				"cache_dir":       "",
+				"storage":         mode,
+			})
+
+			if err := Run(context.Background()); err != nil {
+				t.Fatalf("Run() failed: %s", err)
+			}
+
+			db, err := sql.Open("sqlite3", outputFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			for _, c := range []struct {
+				table, where string
+				want         int
+			}{
+				{"crawl_runs", "status = 'complete' AND files_crawled = 6 AND files_failed = 2", 1},
+				{"manifests", "valid AND url = '" + replayManifestUrl + "' AND crawl_end_ms IS NOT NULL", 1},
+				{"manifest_validation_errors", "1", 0},
+				{"locations", "storage = '" + mode + "' AND size_bytes > 0 AND sha256 <> ''", 1},
+				{"schedules", "storage = '" + mode + "' AND size_bytes > 0 AND sha256 <> ''", 1},
+				{"slots", "storage = '" + mode + "' AND url = 'http://publisher.example/slots-ma.ndjson'", 1},
+				{"slots", "1", 1},
+				{"location_state", "1", 1},
+				{"slot_state", "1", 1},
+				{"crawl_errors", "error_class = 'http_4xx' AND http_status = 404 AND attempts = 1", 1},
+				{"crawl_errors", "error_class = 'http_5xx' AND http_status = 503 AND attempts = 2", 1},
+				{"crawl_errors", "1", 2},
+			} {
+				if got := countRows(t, db, c.table, c.where); got != c.want {
+					t.Errorf("%s rows WHERE %s = %d, want %d", c.table, c.where, got, c.want)
+				}
+			}
+
+			lines := map[string]int{StorageContents: 0, StorageLines: 3, StorageBlob: 0}[mode]
+			if got := countRows(t, db, "slot_lines", "1"); got != lines {
+				t.Errorf("slot_lines has %d rows, want %d", got, lines)
+			}
+			blobs := map[string]int{StorageContents: 0, StorageLines: 0, StorageBlob: 3}[mode]
+			if got := countRows(t, db, "blobs", "1"); got != blobs {
+				t.Errorf("blobs has %d rows, want %d", got, blobs)
+			}
+		})
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// Checkpoint is the progress of a crawl run which did not complete, used to resume it.
+type Checkpoint struct {
+	// The crawl run being resumed.
+	RunId int64
+
+	// Maps manifest URL -> the manifest's row, for manifests which were fetched but whose leaf
+	// files were not all crawled.
+	manifests map[string]ResumedManifest
+
+	// Manifest URLs whose crawl finished, successfully or not.
+	crawled map[string]bool
+}
+
+// ResumedManifest is a manifest fetched by the crawl run being resumed.
+type ResumedManifest struct {
+	// The manifest's primary key.
+	Id int64
+
+	// The manifest's contents.
+	Contents string
+
+	// The URL the manifest was served from, which relative leaf file URLs are resolved against.
+	FinalUrl string
+
+	// The _since parameter the manifest was requested with, or "".
+	Since string
+}
+
+// LoadCheckpoint loads the progress of the latest crawl run in db.
+// Returns an error if db has no crawl runs, or its latest crawl run is complete.
+func LoadCheckpoint(db *sql.DB) (*Checkpoint, error) {
+	c := &Checkpoint{
+		manifests: make(map[string]ResumedManifest),
+		crawled:   make(map[string]bool),
+	}
+	var status string
+	if err := db.QueryRow(
+		"SELECT crawl_run_id, status FROM crawl_runs ORDER BY crawl_run_id DESC LIMIT 1").Scan(&c.RunId, &status); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("no crawl run to resume")
+		}
+		return nil, err
+	}
+	if status == CrawlRunComplete {
+		return nil, fmt.Errorf("crawl run %d is already complete", c.RunId)
+	}
+
+	rows, err := db.Query(
+		"SELECT manifest_id, url, contents, final_url, since, crawl_end_ms FROM manifests WHERE crawl_run_id = ?", c.RunId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var m ResumedManifest
+		var u string
+		var since sql.NullString
+		var crawlEnd sql.NullInt64
+		if err := rows.Scan(&m.Id, &u, &m.Contents, &m.FinalUrl, &since, &crawlEnd); err != nil {
+			return nil, err
+		}
+		if crawlEnd.Valid {
+			c.crawled[u] = true
+			continue
+		}
+		m.Since = since.String
+		c.manifests[u] = m
+	}
+	return c, rows.Err()
+}
+
+// Crawled returns whether manifestUrl was crawled by the crawl run being resumed.
+func (c *Checkpoint) Crawled(manifestUrl string) bool {
+	return c != nil && c.crawled[manifestUrl]
+}
+
+// Manifest returns manifestUrl's row if it was fetched by the crawl run being resumed, but not
+// all of its leaf files were crawled.
+func (c *Checkpoint) Manifest(manifestUrl string) (ResumedManifest, bool) {
+	if c == nil {
+		return ResumedManifest{}, false
+	}
+	m, ok := c.manifests[manifestUrl]
+	return m, ok
+}
+
+// LeafFileUrls returns the URLs of the leaf files of manifestId which are stored in output. Files copied
+// from a previous crawl, which were fetched before the manifest, are not included.
+func (c *Checkpoint) LeafFileUrls(output *sql.DB, manifestId int64) (map[string]bool, error) {
+	urls := make(map[string]bool)
+	for _, table := range leafFileTables {
+		rows, err := output.Query(fmt.Sprintf(`
+      SELECT f.url FROM %s f JOIN manifests m ON m.manifest_id = f.manifest_id
+      WHERE f.manifest_id = ? AND f.fetch_start_ms >= m.fetch_start_ms`, table.FileTable), manifestId)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var u string
+			if err := rows.Scan(&u); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			urls[u] = true
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return urls, nil
+}
+
+// ResumeCrawlRun marks the checkpoint's crawl run as running in output, and deletes the state of
+// its unfinished manifests which will be crawled again: partially stored leaf files, and
+// crawl errors.
+func ResumeCrawlRun(output *sql.DB, c *Checkpoint) error {
+	if _, err := output.Exec(
+		"UPDATE crawl_runs SET status = ?, end_ms = NULL WHERE crawl_run_id = ?", CrawlRunRunning, c.RunId); err != nil {
+		return err
+	}
+	// Files stored with --storage=lines are inserted before their lines, and hashed once all
+	// lines are written. Files whose crawl failed are deleted, but not if the crawler was killed.
+	for _, table := range leafFileTables {
+		if _, err := output.Exec(
+			fmt.Sprintf("DELETE FROM %s WHERE crawl_run_id = ? AND sha256 = ''", table.FileTable), c.RunId); err != nil {
+			return err
+		}
+	}
+	_, err := output.Exec(`
+      DELETE FROM crawl_errors WHERE crawl_run_id = ? AND manifest_url NOT IN (
+        SELECT url FROM manifests WHERE crawl_run_id = ? AND crawl_end_ms IS NOT NULL)`,
+		c.RunId, c.RunId)
+	return err
+}
+
+// CheckpointManifest records that manifestId and all of its leaf files were crawled.
+func CheckpointManifest(output *sql.DB, manifestId int64, end time.Time) error {
+	_, err := output.Exec("UPDATE manifests SET crawl_end_ms = ? WHERE manifest_id = ?",
+		end.UnixNano()/int64(time.Millisecond), manifestId)
+	return err
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// HTTPStatusError is returned by HTTPFetcher when the server responds with a non-2xx status code.
+type HTTPStatusError struct {
+	// The requested URL.
+	Url string
+
+	// The response status code.
+	StatusCode int
+
+	// The delay requested by the server's Retry-After header. 0 if the header is absent.
+	RetryAfter time.Duration
+}
+
+func (e *HTTPStatusError) Error() string {
+	return fmt.Sprintf("GET %s: unexpected status %d %s", e.Url, e.StatusCode, http.StatusText(e.StatusCode))
+}
+
+// FetchError is returned by Retrier when a URL could not be fetched.
+type FetchError struct {
+	// The requested URL.
+	Url string
+
+	// The number of attempts made to fetch Url.
+	Attempts int
+
+	// The error returned by the last attempt.
+	Err error
+}
+
+func (e *FetchError) Error() string {
+	return fmt.Sprintf("%s (attempts: %d)", e.Err, e.Attempts)
+}
+
+func (e *FetchError) Unwrap() error {
+	return e.Err
+}
+
+// IsRetryable returns whether a fetch that failed with err may succeed if retried.
+// Network errors, truncated bodies, and 408, 429, and 5xx (except 501) responses are retryable.
+func IsRetryable(err error) bool {
+	var policyErr *PolicyError
+	if errors.As(err, &policyErr) {
+		return false
+	}
+
+	var statusErr *HTTPStatusError
+	if errors.As(err, &statusErr) {
+		switch statusErr.StatusCode {
+		case http.StatusRequestTimeout, http.StatusTooManyRequests:
+			return true
+		case http.StatusNotImplemented:
+			return false
+		}
+		return statusErr.StatusCode >= 500
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	return errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// ParseRetryAfter parses the value of a Retry-After header, which is either a number of
+// seconds or an HTTP date. Returns 0 if v is empty or malformed.
+func ParseRetryAfter(v string, now time.Time) time.Duration {
+	if v == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(v); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil && t.After(now) {
+		return t.Sub(now)
+	}
+	return 0
+}
+
+// RetryBudget bounds the total number of retries made during a crawl.
+// Thread safe.
+type RetryBudget struct {
+	remaining int64
+}
+
+// NewRetryBudget returns a budget allowing n retries.
+func NewRetryBudget(n int) *RetryBudget {
+	return &RetryBudget{remaining: int64(n)}
+}
+
+// Take consumes a retry from the budget. Returns false if the budget is exhausted.
+func (b *RetryBudget) Take() bool {
+	return atomic.AddInt64(&b.remaining, -1) >= 0
+}
+
+// Retrier retries failed fetches with exponential backoff and jitter.
+type Retrier struct {
+	// The maximum number of attempts per URL, including the first.
+	MaxAttempts int
+
+	// The backoff before the first retry. Doubled for every subsequent retry.
+	BaseDelay time.Duration
+
+	// The maximum backoff between retries. Also caps delays requested by Retry-After.
+	MaxDelay time.Duration
+
+	// The retry budget shared by the whole crawl.
+	Budget *RetryBudget
+
+	// Stats - CrawlStats.RecordRetry will be called for every retry.
+	Stats *CrawlStats
+}
+
+// backoff returns the delay before retry number retry (starting at 0) of a fetch that failed with err.
+func (r *Retrier) backoff(retry int, err error) time.Duration {
+	delay := r.BaseDelay << uint(retry)
+	if delay <= 0 || delay > r.MaxDelay {
+		delay = r.MaxDelay
+	}
+	// Full jitter: spread retries from concurrent fetches over [delay/2, delay).
+	if delay > 1 {
+		delay = delay/2 + time.Duration(rand.Int63n(int64(delay/2)))
+	}
+
+	var statusErr *HTTPStatusError
+	if errors.As(err, &statusErr) && statusErr.RetryAfter > delay {
+		delay = statusErr.RetryAfter
+		if delay > r.MaxDelay {
+			delay = r.MaxDelay
+		}
+	}
+	return delay
+}
+
+// Wrap returns a FetcherFn that retries retryable errors returned by fetchFn, and by reads of the
+// bodies it returns, e.g. truncated bodies and read timeouts. A body whose read fails is fetched again
+// with WithResumeRange and resumed where the failed read left off. Bodies without a strong ETag or a
+// Last-Modified date, and bodies whose ETag or Last-Modified changed, can't be resumed safely, so
+// their reads fail instead.
+// Every fetch counts as an attempt, and errors are returned as *FetchError.
+func (r *Retrier) Wrap(fetchFn FetcherFn) FetcherFn {
+	return func(ctx context.Context, u string) (*FetchResult, error) {
+		f := &retryingFetch{ctx: ctx, retrier: r, fetchFn: fetchFn, url: u}
+		result, err := f.fetch(ctx, nil)
+		if err != nil {
+			return nil, err
+		}
+		f.first = *result
+		f.body = result.Body
+		result.Body = f
+		// Resumed fetches are timed from the first fetch's start.
+		return timeBody(result), nil
+	}
+}
+
+// retryingFetch fetches a URL, and is the body of the FetchResult returned by Retrier.Wrap.
+type retryingFetch struct {
+	ctx     context.Context
+	retrier *Retrier
+	fetchFn FetcherFn
+	url     string
+
+	// The number of attempts made so far.
+	attempts int
+
+	// The first successful fetch. Resumed fetches must serve the same representation.
+	first FetchResult
+
+	// The body being read. nil once closed.
+	body io.ReadCloser
+
+	// The number of bytes read from the body so far.
+	read int64
+
+	// The error returned by every Read once the body could not be resumed.
+	err error
+}
+
+// fetch calls fetchFn with ctx until it succeeds, or fails with an error which may not be retried.
+// err is the error of the previous attempt, or nil if no attempt was made yet.
+func (f *retryingFetch) fetch(ctx context.Context, err error) (*FetchResult, error) {
+	r := f.retrier
+	for {
+		if err != nil {
+			// Errors caused by cancellation look like network errors, so check ctx first.
+			if f.ctx.Err() != nil || f.attempts >= r.MaxAttempts || !IsRetryable(err) || !r.Budget.Take() {
+				return nil, &FetchError{Url: f.url, Attempts: f.attempts, Err: err}
+			}
+
+			r.Stats.RecordRetry()
+			t := time.NewTimer(r.backoff(f.attempts-1, err))
+			select {
+			case <-t.C:
+			case <-f.ctx.Done():
+				t.Stop()
+				return nil, &FetchError{Url: f.url, Attempts: f.attempts, Err: f.ctx.Err()}
+			}
+		}
+
+		f.attempts++
+		var result *FetchResult
+		if result, err = f.fetchFn(ctx, f.url); err == nil {
+			return result, nil
+		}
+	}
+}
+
+// resume fetches the URL again after a read of its body failed with err, and continues from the bytes
+// which were already read. Servers which support range requests only send the remainder of the body.
+func (f *retryingFetch) resume(err error) error {
+	ctx := f.ctx
+	if f.read > 0 {
+		validator := resumeValidator(&f.first)
+		if validator == "" && IsRetryable(err) {
+			return &FetchError{Url: f.url, Attempts: f.attempts, Err: fmt.Errorf("%s has no ETag or Last-Modified to resume it with: %w", f.url, err)}
+		}
+		ctx = WithResumeRange(f.ctx, f.read, validator)
+	}
+	for {
+		result, ferr := f.fetch(ctx, err)
+		if ferr != nil {
+			return ferr
+		}
+		if result.ETag != f.first.ETag || result.LastModified != f.first.LastModified {
+			result.Body.Close()
+			return &FetchError{Url: f.url, Attempts: f.attempts, Err: fmt.Errorf("%s changed while being read: %w", f.url, err)}
+		}
+		if result.StatusCode == http.StatusPartialContent {
+			f.body = result.Body
+			return nil
+		}
+		_, err = io.CopyN(ioutil.Discard, result.Body, f.read)
+		if err == nil {
+			f.body = result.Body
+			return nil
+		}
+		result.Body.Close()
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+	}
+}
+
+// resumeValidator returns the If-Range value which ensures a resumed fetch of r serves the same
+// representation, or "" if r has none. Weak ETags may not be used with If-Range.
+func resumeValidator(r *FetchResult) string {
+	if r.ETag != "" && !strings.HasPrefix(r.ETag, "W/") {
+		return r.ETag
+	}
+	return r.LastModified
+}
+
+// resumeRangeKey is the context key of the range set by WithResumeRange.
+type resumeRangeKey struct{}
+
+// resumeRange is the range set by WithResumeRange.
+type resumeRange struct {
+	offset  int64
+	ifRange string
+}
+
+// WithResumeRange returns a context requesting the part of responses after the first offset bytes,
+// provided that their ETag or Last-Modified matches ifRange. Servers may send the full response instead.
+func WithResumeRange(ctx context.Context, offset int64, ifRange string) context.Context {
+	return context.WithValue(ctx, resumeRangeKey{}, resumeRange{offset: offset, ifRange: ifRange})
+}
+
+// resumeRangeOf returns the range set by WithResumeRange, if any.
+func resumeRangeOf(ctx context.Context) (resumeRange, bool) {
+	r, ok := ctx.Value(resumeRangeKey{}).(resumeRange)
+	return r, ok && r.offset > 0
+}
+
+func (f *retryingFetch) Read(p []byte) (int, error) {
+	for {
+		if f.err != nil {
+			return 0, f.err
+		}
+		n, err := f.body.Read(p)
+		f.read += int64(n)
+		if err == nil || err == io.EOF {
+			return n, err
+		}
+		// Release the failed fetch's limiter slots before fetching again.
+		f.body.Close()
+		f.body = nil
+		if f.err = f.resume(err); f.err != nil {
+			return n, f.err
+		}
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+func (f *retryingFetch) Close() error {
+	if f.body == nil {
+		return nil
+	}
+	err := f.body.Close()
+	f.body = nil
+	return err
+}
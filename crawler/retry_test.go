@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// truncatingServer serves body, but truncates the first truncate responses halfway through.
+// Later responses support range requests.
+func truncatingServer(body string, truncate int32) (*httptest.Server, *int32) {
+	var requests int32
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&requests, 1)
+		w.Header().Set("ETag", `"v1"`)
+		if n <= truncate {
+			w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+			w.Write([]byte(body[:len(body)/2]))
+			return
+		}
+		http.ServeContent(w, r, "", time.Time{}, strings.NewReader(body))
+	}))
+	return s, &requests
+}
+
+func newTestRetrier(maxAttempts, budget int) *Retrier {
+	return &Retrier{
+		MaxAttempts: maxAttempts,
+		BaseDelay:   time.Millisecond,
+		MaxDelay:    time.Millisecond,
+		Budget:      NewRetryBudget(budget),
+		Stats:       &CrawlStats{},
+	}
+}
+
+func TestRetrierResumesTruncatedBody(t *testing.T) {
+	body := strings.Repeat("0123456789\n", 1000)
+	s, requests := truncatingServer(body, 2)
+	defer s.Close()
+
+	r := newTestRetrier(4, 10)
+	fetcher := &HTTPFetcher{Client: s.Client(), Stats: &CrawlStats{}}
+	result, err := r.Wrap(fetcher.Fetch)(context.Background(), s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(result.Body)
+	result.Body.Close()
+	if err != nil {
+		t.Fatalf("ReadAll() failed: %s", err)
+	}
+	if string(got) != body {
+		t.Errorf("ReadAll() = %d bytes, want %d bytes", len(got), len(body))
+	}
+	if *requests != 3 {
+		t.Errorf("server received %d requests, want 3", *requests)
+	}
+	if r.Stats.retryCount != 2 {
+		t.Errorf("retryCount = %d, want 2", r.Stats.retryCount)
+	}
+}
+
+func TestRetrierTruncatedBodyCountsAttempts(t *testing.T) {
+	body := strings.Repeat("0123456789\n", 1000)
+	s, requests := truncatingServer(body, 100)
+	defer s.Close()
+
+	r := newTestRetrier(3, 10)
+	fetcher := &HTTPFetcher{Client: s.Client(), Stats: &CrawlStats{}}
+	result, err := r.Wrap(fetcher.Fetch)(context.Background(), s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ioutil.ReadAll(result.Body)
+	result.Body.Close()
+	var fetchErr *FetchError
+	if !errors.As(err, &fetchErr) {
+		t.Fatalf("ReadAll() = %v, want *FetchError", err)
+	}
+	if fetchErr.Attempts != 3 || *requests != 3 {
+		t.Errorf("Attempts = %d with %d requests, want 3 attempts and requests", fetchErr.Attempts, *requests)
+	}
+	if !IsRetryable(fetchErr.Err) {
+		t.Errorf("FetchError.Err = %v, want a retryable error", fetchErr.Err)
+	}
+}
+
+func TestRetrierDoesNotResumeBodyWithoutValidators(t *testing.T) {
+	// Serves a different version of the body to every request, truncating all but the last.
+	versions := []string{strings.Repeat("a\n", 1000), strings.Repeat("b\n", 1000)}
+	var requests int32
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := int(atomic.AddInt32(&requests, 1))
+		if n >= len(versions) {
+			w.Write([]byte(versions[len(versions)-1]))
+			return
+		}
+		body := versions[n-1]
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		w.Write([]byte(body[:len(body)/2]))
+	}))
+	defer s.Close()
+
+	r := newTestRetrier(4, 10)
+	fetcher := &HTTPFetcher{Client: s.Client(), Stats: &CrawlStats{}}
+	result, err := r.Wrap(fetcher.Fetch)(context.Background(), s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(result.Body)
+	result.Body.Close()
+	var fetchErr *FetchError
+	if !errors.As(err, &fetchErr) {
+		t.Fatalf("ReadAll() = %v, want *FetchError", err)
+	}
+	if strings.Contains(string(got), "b") {
+		t.Errorf("ReadAll() spliced the second version of the body onto the first")
+	}
+	if requests != 1 {
+		t.Errorf("server received %d requests, want 1", requests)
+	}
+}
+
+func TestRetrierSendsIfRange(t *testing.T) {
+	body := strings.Repeat("0123456789\n", 1000)
+	var ranges []string
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ranges = append(ranges, r.Header.Get("Range")+" "+r.Header.Get("If-Range"))
+		// The body changed after the first response, so If-Range doesn't match and the full v2 is sent.
+		if len(ranges) == 1 {
+			w.Header().Set("ETag", `"v1"`)
+			w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+			w.Write([]byte(body[:len(body)/2]))
+			return
+		}
+		w.Header().Set("ETag", `"v2"`)
+		http.ServeContent(w, r, "", time.Time{}, strings.NewReader(body))
+	}))
+	defer s.Close()
+
+	r := newTestRetrier(4, 10)
+	fetcher := &HTTPFetcher{Client: s.Client(), Stats: &CrawlStats{}}
+	result, err := r.Wrap(fetcher.Fetch)(context.Background(), s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ioutil.ReadAll(result.Body)
+	result.Body.Close()
+	if err == nil || !strings.Contains(err.Error(), "changed while being read") {
+		t.Errorf("ReadAll() = %v, want an error as the body changed", err)
+	}
+	want := []string{" ", fmt.Sprintf("bytes=%d- \"v1\"", len(body)/2)}
+	if !reflect.DeepEqual(ranges, want) {
+		t.Errorf("Range and If-Range headers = %q, want %q", ranges, want)
+	}
+}
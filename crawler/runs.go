@@ -0,0 +1,98 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"time"
+)
+
+// OpenDatabase opens the long-lived crawler database filename, creating it with schema if
+// it doesn't exist. Unlike OpenOutput, existing crawl runs are preserved.
+func OpenDatabase(filename, schema string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite3", filename)
+	if err != nil {
+		return nil, err
+	}
+	// Pragmas are per connection, and are only set by schema when the database is created.
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec("PRAGMA foreign_keys = ON"); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	var tables int
+	if err := db.QueryRow(
+		"SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'crawl_runs'").Scan(&tables); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if tables == 0 {
+		if _, err := db.Exec(schema); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	return db, nil
+}
+
+// FlagConfig returns the crawler's flags and their values as a JSON object.
+func FlagConfig() string {
+	config := make(map[string]string)
+	flag.VisitAll(func(f *flag.Flag) {
+		config[f.Name] = f.Value.String()
+	})
+	c, _ := json.Marshal(config)
+	return string(c)
+}
+
+// Crawl run statuses recorded in the crawl_runs table.
+const (
+	CrawlRunRunning     = "running"
+	CrawlRunComplete    = "complete"
+	CrawlRunInterrupted = "interrupted"
+)
+
+// StartCrawlRun records the start of a crawl run with the given config into output.
+// Returns the crawl run's id.
+func StartCrawlRun(output *sql.DB, config string, start time.Time) (int64, error) {
+	res, err := output.Exec(
+		"INSERT INTO crawl_runs (start_ms, status, config) VALUES (?, ?, ?)",
+		start.UnixNano()/int64(time.Millisecond), CrawlRunRunning, config)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+// EndCrawlRun records the end of crawl run runId, its status, and its stats into output.
+func EndCrawlRun(output *sql.DB, runId int64, status string, stats *CrawlStats, end time.Time) error {
+	_, err := output.Exec(`
+      UPDATE crawl_runs SET end_ms = ?, status = ?, files_crawled = ?, files_failed = ?, stats = ?
+      WHERE crawl_run_id = ?`,
+		end.UnixNano()/int64(time.Millisecond), status, stats.FileCount(), len(stats.Failures()), stats.String(), runId)
+	return err
+}
+
+// PruneCrawlRuns deletes all but the latest retain crawl runs, the files crawled by them, and
+// blobs no longer referenced by any file from output. Returns the number of deleted runs.
+func PruneCrawlRuns(output *sql.DB, retain int) (int64, error) {
+	res, err := output.Exec(`
+      DELETE FROM crawl_runs WHERE crawl_run_id NOT IN (
+        SELECT crawl_run_id FROM crawl_runs ORDER BY crawl_run_id DESC LIMIT ?)`,
+		retain)
+	if err != nil {
+		return 0, err
+	}
+	pruned, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = output.Exec(`
+      DELETE FROM blobs WHERE sha256 NOT IN (
+        SELECT sha256 FROM locations WHERE storage = 'blob'
+        UNION SELECT sha256 FROM schedules WHERE storage = 'blob'
+        UNION SELECT sha256 FROM slots WHERE storage = 'blob')`)
+	return pruned, err
+}
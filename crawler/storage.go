@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Storage modes for leaf file contents. See --storage.
+const (
+	// The whole file is stored in the file table's contents column.
+	StorageContents = "contents"
+	// Each non-empty line is stored as a row in the file's lines table, e.g. slot_lines.
+	// Files are streamed, so memory use is bounded by --max_line_bytes rather than the file size.
+	StorageLines = "lines"
+	// The file is stored compressed in the blobs table, keyed by the SHA-256 of its contents.
+	// Identical files are stored once.
+	StorageBlob = "blob"
+)
+
+// Compression algorithms for StorageBlob. See --compression.
+const (
+	CompressionNone = "none"
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+)
+
+// linesBatchSize is the number of lines written per transaction in StorageLines mode.
+// Larger batches are faster, but hold the output's single connection longer.
+const linesBatchSize = 1000
+
+// StoredContents describes how a file's contents are stored in a file table.
+type StoredContents struct {
+	// StorageContents, StorageLines, or StorageBlob.
+	Storage string
+
+	// The file's contents if Storage is StorageContents, nil otherwise.
+	Contents *string
+
+	// The size of the file in bytes.
+	SizeBytes int64
+
+	// The hex encoded SHA-256 of the file's contents.
+	Sha256 string
+}
+
+// ReadContents reads body for storage in a file table's contents column.
+func ReadContents(body io.Reader) (*StoredContents, error) {
+	b, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	contents := string(b)
+	h := sha256.Sum256(b)
+	return &StoredContents{
+		Storage:   StorageContents,
+		Contents:  &contents,
+		SizeBytes: int64(len(b)),
+		Sha256:    hex.EncodeToString(h[:]),
+	}, nil
+}
+
+// WriteBlob compresses body into the blobs table, unless a blob with the same contents is
+// already stored. Only the compressed contents are held in memory.
+func WriteBlob(output *sql.DB, body io.Reader, compression string) (*StoredContents, error) {
+	var compressed bytes.Buffer
+	var w io.WriteCloser
+	switch compression {
+	case CompressionNone:
+		w = nopWriteCloser{&compressed}
+	case CompressionGzip:
+		w = gzip.NewWriter(&compressed)
+	case CompressionZstd:
+		zw, err := zstd.NewWriter(&compressed)
+		if err != nil {
+			return nil, err
+		}
+		w = zw
+	default:
+		return nil, fmt.Errorf("unknown compression '%s'", compression)
+	}
+
+	hasher := sha256.New()
+	size, err := io.Copy(io.MultiWriter(w, hasher), body)
+	if err != nil {
+		w.Close()
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	c := &StoredContents{Storage: StorageBlob, SizeBytes: size, Sha256: hex.EncodeToString(hasher.Sum(nil))}
+	if _, err := output.Exec(
+		"INSERT OR IGNORE INTO blobs (sha256, compression, size_bytes, data) VALUES (?, ?, ?, ?)",
+		c.Sha256, compression, size, compressed.Bytes()); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// nopWriteCloser adds a no-op Close to an io.Writer.
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// countingReader counts the bytes read from r.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// WriteLines streams the non-empty lines of body into table's lines table under fileId.
+// Lines longer than maxLineBytes fail the write. Returns the number of bytes read from body and
+// the hex encoded SHA-256 of body.
+func WriteLines(output *sql.DB, table leafFileTable, fileId int64, body io.Reader, maxLineBytes int) (int64, string, error) {
+	hasher := sha256.New()
+	counter := &countingReader{r: io.TeeReader(body, hasher)}
+	scanner := bufio.NewScanner(counter)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxLineBytes)
+
+	w := &linesWriter{output: output, table: table, fileId: fileId}
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := trimCR(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if err := w.add(lineNumber, line); err != nil {
+			return counter.n, "", err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		if err == bufio.ErrTooLong {
+			return counter.n, "", fmt.Errorf("line %d longer than %d bytes", lineNumber+1, maxLineBytes)
+		}
+		return counter.n, "", err
+	}
+	return counter.n, hex.EncodeToString(hasher.Sum(nil)), w.flush()
+}
+
+// trimCR removes a trailing carriage return left by "\r\n" line endings.
+func trimCR(line string) string {
+	if len(line) > 0 && line[len(line)-1] == '\r' {
+		return line[:len(line)-1]
+	}
+	return line
+}
+
+// linesWriter batches rows written into a lines table.
+type linesWriter struct {
+	output *sql.DB
+	table  leafFileTable
+	fileId int64
+
+	lineNumbers []int
+	lines       []string
+}
+
+// add buffers a line, writing the buffer once it reaches linesBatchSize lines.
+func (w *linesWriter) add(lineNumber int, line string) error {
+	w.lineNumbers = append(w.lineNumbers, lineNumber)
+	w.lines = append(w.lines, line)
+	if len(w.lines) >= linesBatchSize {
+		return w.flush()
+	}
+	return nil
+}
+
+// flush writes the buffered lines in a single transaction.
+func (w *linesWriter) flush() error {
+	if len(w.lines) == 0 {
+		return nil
+	}
+
+	tx, err := w.output.Begin()
+	if err != nil {
+		return err
+	}
+	stmt, err := tx.Prepare(fmt.Sprintf(
+		"INSERT INTO %s (%s, line_number, contents) VALUES (?, ?, ?)", w.table.LinesTable, w.table.StateJoinTableFK))
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	for i, line := range w.lines {
+		if _, err := stmt.Exec(w.fileId, w.lineNumbers[i], line); err != nil {
+			stmt.Close()
+			tx.Rollback()
+			return err
+		}
+	}
+	stmt.Close()
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	w.lineNumbers = w.lineNumbers[:0]
+	w.lines = w.lines[:0]
+	return nil
+}
+
+// releaseOnCloseBody calls release once, when the body is closed.
+type releaseOnCloseBody struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (b *releaseOnCloseBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
+
+// releaseOnClose wraps r's body so that release is called once the caller closes it.
+// Used by limiters to hold their slot while the body is streamed.
+func releaseOnClose(r *FetchResult, release func()) *FetchResult {
+	r.Body = &releaseOnCloseBody{ReadCloser: r.Body, release: release}
+	return r
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// ManifestValidationError is a problem with a manifest file found by ValidateManifest.
+type ManifestValidationError struct {
+	// The jq style path of the offending field, e.g. `.["output"][0]["type"]`. "." for the whole file.
+	Field string
+
+	// What is wrong with the field.
+	Message string
+}
+
+func (e *ManifestValidationError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Field, e.Message)
+}
+
+// InvalidManifestError is returned when a manifest fails validation.
+type InvalidManifestError struct {
+	Url    string
+	Errors []*ManifestValidationError
+}
+
+func (e *InvalidManifestError) Error() string {
+	return fmt.Sprintf("manifest %s is invalid: %s (%d errors, see manifest_validation_errors)", e.Url, e.Errors[0], len(e.Errors))
+}
+
+// iso8601Layouts are the ISO 8601 timestamp formats accepted in manifests.
+var iso8601Layouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05",
+	"2006-01-02T15:04",
+	"2006-01-02",
+}
+
+// manifestValidator accumulates the errors found while validating a manifest.
+type manifestValidator struct {
+	// The URL the manifest was served from.
+	manifestUrl string
+
+	errors []*ManifestValidationError
+}
+
+func (v *manifestValidator) errorf(field []interface{}, format string, args ...interface{}) {
+	path := "."
+	for _, f := range field {
+		if s, ok := f.(string); ok {
+			path += fmt.Sprintf("[%q]", s)
+		} else {
+			path += fmt.Sprintf("[%v]", f)
+		}
+	}
+	v.errors = append(v.errors, &ManifestValidationError{Field: path, Message: fmt.Sprintf(format, args...)})
+}
+
+// ValidateManifest validates the manifest file served from manifestUrl with the given contents against
+// https://github.com/smart-on-fhir/smart-scheduling-links/blob/master/specification.md#manifest-file,
+// mirroring validate_manifest in validator/validator_lib.rb. Returns nil if the manifest is valid.
+// Output URLs may be relative to manifestUrl, and may be file:// URLs if manifestUrl is.
+func ValidateManifest(manifestUrl string, contents string) []*ManifestValidationError {
+	v := &manifestValidator{manifestUrl: manifestUrl}
+	if u, err := url.Parse(manifestUrl); err != nil || !strings.HasSuffix(u.Path, ManifestFileName) {
+		v.errorf(nil, "manifest URL %s does not end with %s", manifestUrl, ManifestFileName)
+	}
+
+	var parsed interface{}
+	if err := json.Unmarshal([]byte(contents), &parsed); err != nil {
+		v.errorf(nil, "cannot be parsed as JSON: %s", err)
+		return v.errors
+	}
+	obj, ok := parsed.(map[string]interface{})
+	if !ok {
+		v.errorf(nil, "is not a JSON object")
+		return v.errors
+	}
+
+	if s, ok := v.requireString(obj, nil, "transactionTime"); ok {
+		v.checkTimestamp([]interface{}{"transactionTime"}, s)
+	}
+	if s, ok := v.requireString(obj, nil, "request"); ok {
+		v.checkUrl([]interface{}{"request"}, s)
+	}
+
+	output, ok := obj["output"]
+	if !ok {
+		v.errorf(nil, "missing required field 'output'")
+		return v.errors
+	}
+	outputs, ok := output.([]interface{})
+	if !ok {
+		v.errorf([]interface{}{"output"}, "is not a JSON array")
+		return v.errors
+	}
+	if len(outputs) == 0 {
+		v.errorf([]interface{}{"output"}, "JSON array cannot be empty")
+	}
+	for i, o := range outputs {
+		v.checkOutput([]interface{}{"output", i}, o)
+	}
+	return v.errors
+}
+
+// checkOutput validates an element of the manifest's output array.
+func (v *manifestValidator) checkOutput(field []interface{}, o interface{}) {
+	obj, ok := o.(map[string]interface{})
+	if !ok {
+		v.errorf(field, "is not a JSON object")
+		return
+	}
+	if s, ok := v.requireString(obj, field, "type"); ok {
+		if _, known := leafFileTables[s]; !known {
+			v.errorf(append(field, "type"), "unrecognized field value '%s'. Must be one of Location, Schedule, or Slot", s)
+		}
+	}
+	if s, ok := v.requireString(obj, field, "url"); ok {
+		v.checkOutputUrl(append(field, "url"), s)
+	}
+
+	extension, ok := obj["extension"]
+	if !ok {
+		return
+	}
+	field = append(field, "extension")
+	ext, ok := extension.(map[string]interface{})
+	if !ok {
+		v.errorf(field, "is not a JSON object")
+		return
+	}
+	state, ok := ext["state"]
+	if !ok {
+		v.errorf(field, "missing required field 'state'")
+		return
+	}
+	states, ok := state.([]interface{})
+	if !ok {
+		v.errorf(append(field, "state"), "is not a JSON array of strings")
+		return
+	}
+	for i, s := range states {
+		str, ok := s.(string)
+		if !ok {
+			v.errorf(append(field, "state", i), "not a string")
+			continue
+		}
+		// State codes are case-insensitive, as when CrawlLeafFile records the file's states.
+		if _, ok := StateById[strings.ToUpper(str)]; !ok {
+			v.errorf(append(field, "state", i), "unrecognized state '%s'", str)
+		}
+	}
+}
+
+// requireString returns obj[name] if it is a string, and records an error otherwise.
+// field is the path of obj.
+func (v *manifestValidator) requireString(obj map[string]interface{}, field []interface{}, name string) (string, bool) {
+	value, ok := obj[name]
+	if !ok {
+		v.errorf(field, "missing required field '%s'", name)
+		return "", false
+	}
+	s, ok := value.(string)
+	if !ok {
+		v.errorf(append(field, name), "is not a string")
+		return "", false
+	}
+	return s, true
+}
+
+func (v *manifestValidator) checkTimestamp(field []interface{}, s string) {
+	for _, layout := range iso8601Layouts {
+		if _, err := time.Parse(layout, s); err == nil {
+			return
+		}
+	}
+	v.errorf(field, "cannot be parsed as a ISO8601 timestamp. Got '%s'", s)
+}
+
+// checkOutputUrl checks an output URL, which is resolved against the manifest's URL.
+func (v *manifestValidator) checkOutputUrl(field []interface{}, s string) {
+	u, err := url.Parse(ResolveUrl(v.manifestUrl, s))
+	if err == nil && u.Scheme == "file" && IsLocalUrl(v.manifestUrl) {
+		return
+	}
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		v.errorf(field, "is not a URL. Got '%s'", s)
+	}
+}
+
+func (v *manifestValidator) checkUrl(field []interface{}, s string) {
+	u, err := url.Parse(s)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		v.errorf(field, "is not a URL. Got '%s'", s)
+	}
+}
+
+// RecordManifestValidationErrors records errs found in manifest manifestId into output.
+func RecordManifestValidationErrors(output *sql.DB, manifestId int64, errs []*ManifestValidationError) error {
+	for _, e := range errs {
+		if _, err := output.Exec(
+			"INSERT INTO manifest_validation_errors (manifest_id, field, message) VALUES (?, ?, ?)",
+			manifestId, e.Field, e.Message); err != nil {
+			return err
+		}
+	}
+	return nil
+}
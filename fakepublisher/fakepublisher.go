@@ -0,0 +1,503 @@
+// Package fakepublisher serves a synthetic Slot Publisher, as defined by
+// https://github.com/smart-on-fhir/smart-scheduling-links/blob/master/specification.md,
+// for testing the crawler and parser end to end without network access.
+//
+// The server generates a $bulk-publish manifest and Location, Schedule, and Slot files from Options,
+// and can be configured to misbehave: fail with HTTP errors, respond slowly, redirect, serve
+// malformed lines, or serve huge files. Slots booked with Server.Book are served incrementally to
+// manifest requests with _since, to test incremental crawls.
+//
+// Example:
+//
+//	s := fakepublisher.NewServer(fakepublisher.Options{Locations: 10, Errors: map[string]int{"/slots-1.ndjson": 503}})
+//	defer s.Close()
+//	crawl(s.ManifestUrl())
+package fakepublisher
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Paths of the files served by the Server.
+const (
+	ManifestPath  = "/$bulk-publish"
+	LocationsPath = "/locations.ndjson"
+	SchedulesPath = "/schedules.ndjson"
+	// Slots are split into Options.SlotFiles files: /slots-0.ndjson, /slots-1.ndjson, etc...
+	SlotsPathFormat = "/slots-%d.ndjson"
+	// Only listed in the manifest if Options.HugeFileBytes > 0.
+	HugeSlotsPath = "/huge.ndjson"
+)
+
+// Options configure the data served by a Server, and how it misbehaves.
+// Zero values use the defaults noted on each field.
+type Options struct {
+	// The number of locations. Defaults to 1.
+	Locations int
+
+	// The number of schedules of each location. Defaults to 1.
+	SchedulesPerLocation int
+
+	// The number of slots of each schedule. Defaults to 1.
+	SlotsPerSchedule int
+
+	// The number of files the slots are split into. Defaults to 1.
+	SlotFiles int
+
+	// Two character names of the states the locations are in, assigned round robin. Defaults to ["MA"].
+	States []string
+
+	// The manifest's transactionTime. Defaults to 2021-04-01T00:00:00Z.
+	TransactionTime time.Time
+
+	// The start of the first slot. Slots of a schedule are an hour apart. Defaults to 2021-04-02T09:00:00Z.
+	FirstSlotStart time.Time
+
+	// Maps path -> the HTTP status code every request to it fails with, e.g. {"/slots-0.ndjson": 503}.
+	Errors map[string]int
+
+	// Maps path -> the number of requests to it which fail with 503 before it is served, e.g. to test
+	// retries. Redirected requests don't count, so each fetch following Redirects is one request.
+	FailFirst map[string]int
+
+	// Maps path -> how long requests to it wait before responding.
+	Delays map[string]time.Duration
+
+	// Maps path -> how long requests to it stall after sending the response headers and the first
+	// line of the body, e.g. to test read timeouts.
+	Stalls map[string]time.Duration
+
+	// Maps path -> the number of redirects followed before it is served.
+	Redirects map[string]int
+
+	// If > 0, every MalformedLineEvery-th line of Location, Schedule, and Slot files is malformed JSON.
+	MalformedLineEvery int
+
+	// If > 0, the manifest lists an additional Slot file of about this many bytes, made up of valid
+	// slots which are generated while streaming it.
+	HugeFileBytes int64
+}
+
+// withDefaults returns a copy of o with defaults set for zero values.
+func (o Options) withDefaults() Options {
+	if o.Locations <= 0 {
+		o.Locations = 1
+	}
+	if o.SchedulesPerLocation <= 0 {
+		o.SchedulesPerLocation = 1
+	}
+	if o.SlotsPerSchedule <= 0 {
+		o.SlotsPerSchedule = 1
+	}
+	if o.SlotFiles <= 0 {
+		o.SlotFiles = 1
+	}
+	if len(o.States) == 0 {
+		o.States = []string{"MA"}
+	}
+	if o.TransactionTime.IsZero() {
+		o.TransactionTime = time.Date(2021, 4, 1, 0, 0, 0, 0, time.UTC)
+	}
+	if o.FirstSlotStart.IsZero() {
+		o.FirstSlotStart = time.Date(2021, 4, 2, 9, 0, 0, 0, time.UTC)
+	}
+	return o
+}
+
+// Server is a fake Slot Publisher listening on a local address. Thread safe.
+type Server struct {
+	*httptest.Server
+
+	opts Options
+
+	mu sync.Mutex
+	// Maps path -> the number of requests received for it.
+	requests map[string]int
+	// Maps path -> the number of requests received for it which were not redirected.
+	finalRequests map[string]int
+	// The manifest's transactionTime. Advanced by Book.
+	transactionTime time.Time
+	// Maps slot id -> when it was booked.
+	booked map[string]time.Time
+	// The _since of the latest manifest request. Zero if it had none.
+	since time.Time
+}
+
+// NewServer starts a Server serving the data configured by opts. The caller must Close it.
+func NewServer(opts Options) *Server {
+	s := &Server{
+		opts:          opts.withDefaults(),
+		requests:      make(map[string]int),
+		finalRequests: make(map[string]int),
+		booked:        make(map[string]time.Time),
+	}
+	s.transactionTime = s.opts.TransactionTime
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// Book marks the slots with slotIds busy as of at, and advances the manifest's transactionTime to at.
+//
+// Like publishers which reuse file URLs, the server answers a manifest request with _since by listing
+// only the Slot files with slots booked since, at their usual URLs. Until the next manifest request,
+// those files only serve the slots booked since, and Location and Schedule files are not listed.
+func (s *Server) Book(at time.Time, slotIds ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, id := range slotIds {
+		s.booked[id] = at
+	}
+	s.transactionTime = at
+}
+
+// ManifestUrl returns the URL of the server's manifest.
+func (s *Server) ManifestUrl() string {
+	return s.URL + ManifestPath
+}
+
+// Requests returns the number of requests received for path, including redirected and failed requests.
+func (s *Server) Requests(path string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests[path]
+}
+
+// LocationId returns the id of the l-th location.
+func LocationId(l int) string {
+	return fmt.Sprintf("location-%d", l)
+}
+
+// ScheduleId returns the id of the sc-th schedule of the l-th location.
+func ScheduleId(l, sc int) string {
+	return fmt.Sprintf("schedule-%d-%d", l, sc)
+}
+
+// SlotId returns the id of the sl-th slot of schedule ScheduleId(l, sc).
+func SlotId(l, sc, sl int) string {
+	return fmt.Sprintf("slot-%d-%d-%d", l, sc, sl)
+}
+
+func slotsPath(file int) string {
+	return fmt.Sprintf(SlotsPathFormat, file)
+}
+
+// parseSlotsPath returns the index of the slot file at path, or false if path is not a slot file.
+func parseSlotsPath(path string) (int, bool) {
+	if !strings.HasPrefix(path, "/slots-") || !strings.HasSuffix(path, ".ndjson") {
+		return 0, false
+	}
+	n, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(path, "/slots-"), ".ndjson"))
+	return n, err == nil && n >= 0
+}
+
+// state returns the state of the l-th location.
+func (s *Server) state(l int) string {
+	return s.opts.States[l%len(s.opts.States)]
+}
+
+// slotFile returns the index of the file the slots of schedule ScheduleId(l, sc) are in.
+func (s *Server) slotFile(l, sc int) int {
+	return (l*s.opts.SchedulesPerLocation + sc) % s.opts.SlotFiles
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.Path
+	s.mu.Lock()
+	s.requests[path]++
+	s.mu.Unlock()
+
+	if hops := s.opts.Redirects[path]; hops > 0 {
+		hop, _ := strconv.Atoi(r.URL.Query().Get("hop"))
+		if hop < hops {
+			q := r.URL.Query()
+			q.Set("hop", strconv.Itoa(hop+1))
+			http.Redirect(w, r, path+"?"+q.Encode(), http.StatusFound)
+			return
+		}
+	}
+	s.mu.Lock()
+	s.finalRequests[path]++
+	count := s.finalRequests[path]
+	s.mu.Unlock()
+	if !sleep(r, s.opts.Delays[path]) {
+		return
+	}
+	if status := s.opts.Errors[path]; status != 0 {
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+	if count <= s.opts.FailFirst[path] {
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
+	}
+
+	var lines func(emit func(v interface{}) bool)
+	switch {
+	case path == ManifestPath:
+		since, _ := time.Parse(time.RFC3339, r.URL.Query().Get("_since"))
+		s.mu.Lock()
+		s.since = since
+		manifest := s.manifest()
+		s.mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(manifest)
+		return
+	case path == LocationsPath:
+		lines = s.locations
+	case path == SchedulesPath:
+		lines = s.schedules
+	case path == HugeSlotsPath && s.opts.HugeFileBytes > 0:
+		lines = s.hugeSlots
+	default:
+		file, ok := parseSlotsPath(path)
+		if !ok || file >= s.opts.SlotFiles || path != slotsPath(file) {
+			http.NotFound(w, r)
+			return
+		}
+		lines = func(emit func(v interface{}) bool) { s.slots(file, emit) }
+	}
+	s.serveLines(w, r, lines)
+}
+
+// sleep waits for d, or until r is cancelled. Returns false if r was cancelled.
+func sleep(r *http.Request, d time.Duration) bool {
+	if d <= 0 {
+		return true
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-r.Context().Done():
+		return false
+	}
+}
+
+// serveLines writes the resources emitted by lines as NDJSON, malforming lines if configured.
+func (s *Server) serveLines(w http.ResponseWriter, r *http.Request, lines func(emit func(v interface{}) bool)) {
+	w.Header().Set("Content-Type", "application/fhir+ndjson")
+	// Allows the crawler to resume files which are truncated or stall.
+	s.mu.Lock()
+	w.Header().Set("Last-Modified", s.transactionTime.UTC().Format(http.TimeFormat))
+	s.mu.Unlock()
+	bw := bufio.NewWriter(w)
+	defer bw.Flush()
+	n := 0
+	lines(func(v interface{}) bool {
+		n++
+		b, err := json.Marshal(v)
+		if err != nil {
+			panic(err)
+		}
+		if s.opts.MalformedLineEvery > 0 && n%s.opts.MalformedLineEvery == 0 {
+			// Truncate the line mid-object.
+			b = b[:len(b)/2]
+		}
+		if _, err := bw.Write(append(b, '\n')); err != nil {
+			return false
+		}
+		if n == 1 {
+			if stall := s.opts.Stalls[r.URL.Path]; stall > 0 {
+				bw.Flush()
+				if f, ok := w.(http.Flusher); ok {
+					f.Flush()
+				}
+				return sleep(r, stall)
+			}
+		}
+		return true
+	})
+}
+
+// manifest returns the manifest, listing only files with changes if it was requested with _since.
+// The caller must hold mu.
+func (s *Server) manifest() map[string]interface{} {
+	var output []map[string]interface{}
+	add := func(fileType, path string, states []string) {
+		output = append(output, map[string]interface{}{
+			"type":      fileType,
+			"url":       s.URL + path,
+			"extension": map[string]interface{}{"state": states},
+		})
+	}
+	request := s.ManifestUrl()
+	if !s.since.IsZero() {
+		request += "?_since=" + url.QueryEscape(s.since.Format(time.RFC3339))
+		changed := make(map[int]bool)
+		s.forEachSlot(func(l, sc, sl int) {
+			if s.booked[SlotId(l, sc, sl)].After(s.since) {
+				changed[s.slotFile(l, sc)] = true
+			}
+		})
+		for f := 0; f < s.opts.SlotFiles; f++ {
+			if changed[f] {
+				add("Slot", slotsPath(f), s.opts.States)
+			}
+		}
+	} else {
+		add("Location", LocationsPath, s.opts.States)
+		add("Schedule", SchedulesPath, s.opts.States)
+		for f := 0; f < s.opts.SlotFiles; f++ {
+			add("Slot", slotsPath(f), s.opts.States)
+		}
+		if s.opts.HugeFileBytes > 0 {
+			add("Slot", HugeSlotsPath, s.opts.States)
+		}
+	}
+	return map[string]interface{}{
+		"transactionTime": s.transactionTime.Format(time.RFC3339),
+		"request":         request,
+		"output":          output,
+	}
+}
+
+// forEachSlot calls f with the location, schedule, and slot index of every slot.
+func (s *Server) forEachSlot(f func(l, sc, sl int)) {
+	for l := 0; l < s.opts.Locations; l++ {
+		for sc := 0; sc < s.opts.SchedulesPerLocation; sc++ {
+			for sl := 0; sl < s.opts.SlotsPerSchedule; sl++ {
+				f(l, sc, sl)
+			}
+		}
+	}
+}
+
+func (s *Server) locations(emit func(v interface{}) bool) {
+	for l := 0; l < s.opts.Locations; l++ {
+		if !emit(map[string]interface{}{
+			"resourceType": "Location",
+			"id":           LocationId(l),
+			"name":         fmt.Sprintf("Fake Pharmacy #%d", l),
+			"telecom": []map[string]string{
+				{"system": "phone", "value": fmt.Sprintf("555-%04d", l%10000)},
+				{"system": "url", "value": fmt.Sprintf("%s/locations/%d", s.URL, l)},
+			},
+			"address": map[string]interface{}{
+				"line":       []string{fmt.Sprintf("%d Main St", l+1)},
+				"city":       "Springfield",
+				"state":      s.state(l),
+				"postalCode": fmt.Sprintf("%05d", l%100000),
+				"district":   "Hampden",
+			},
+			"description": "A fake location.",
+			"position":    map[string]float64{"latitude": 42.1 + float64(l)/1000, "longitude": -72.5 - float64(l)/1000},
+			"identifier": []map[string]string{
+				{"system": "https://cdc.gov/vaccines/programs/vtrcks", "value": fmt.Sprintf("CV%07d", l)},
+			},
+		}) {
+			return
+		}
+	}
+}
+
+func (s *Server) schedules(emit func(v interface{}) bool) {
+	for l := 0; l < s.opts.Locations; l++ {
+		for sc := 0; sc < s.opts.SchedulesPerLocation; sc++ {
+			if !emit(map[string]interface{}{
+				"resourceType": "Schedule",
+				"id":           ScheduleId(l, sc),
+				"actor":        []map[string]string{{"reference": "Location/" + LocationId(l)}},
+				"serviceType": []map[string]interface{}{{
+					"coding": []map[string]string{
+						{"system": "http://terminology.hl7.org/CodeSystem/service-type", "code": "57", "display": "Immunization"},
+						{"system": "http://fhir-registry.smarthealthit.org/CodeSystem/service-type", "code": "covid19-immunization", "display": "COVID-19 Immunization Appointment"},
+					},
+				}},
+				"extension": []map[string]interface{}{
+					{
+						"url":         "http://fhir-registry.smarthealthit.org/StructureDefinition/vaccine-product",
+						"valueCoding": map[string]string{"system": "http://hl7.org/fhir/sid/cvx", "code": "207", "display": "Moderna"},
+					},
+					{
+						"url":          "http://fhir-registry.smarthealthit.org/StructureDefinition/vaccine-dose",
+						"valueInteger": 1 + sc%2,
+					},
+				},
+			}) {
+				return
+			}
+		}
+	}
+}
+
+func (s *Server) slot(id, scheduleId, status string, start time.Time) map[string]interface{} {
+	return map[string]interface{}{
+		"resourceType": "Slot",
+		"id":           id,
+		"schedule":     map[string]string{"reference": "Schedule/" + scheduleId},
+		"status":       status,
+		"start":        start.Format(time.RFC3339),
+		"end":          start.Add(time.Hour).Format(time.RFC3339),
+		"extension": []map[string]interface{}{
+			{
+				"url":      "http://fhir-registry.smarthealthit.org/StructureDefinition/booking-deep-link",
+				"valueUrl": fmt.Sprintf("%s/book?slot=%s", s.URL, id),
+			},
+			{
+				"url":         "http://fhir-registry.smarthealthit.org/StructureDefinition/booking-phone",
+				"valueString": "555-0000",
+			},
+			{
+				"url":          "http://fhir-registry.smarthealthit.org/StructureDefinition/slot-capacity",
+				"valueInteger": 1,
+			},
+		},
+	}
+}
+
+// slots emits the slots in file, or only those booked since the latest manifest request's _since.
+func (s *Server) slots(file int, emit func(v interface{}) bool) {
+	s.mu.Lock()
+	since := s.since
+	booked := make(map[string]time.Time, len(s.booked))
+	for id, at := range s.booked {
+		booked[id] = at
+	}
+	s.mu.Unlock()
+
+	for l := 0; l < s.opts.Locations; l++ {
+		for sc := 0; sc < s.opts.SchedulesPerLocation; sc++ {
+			if s.slotFile(l, sc) != file {
+				continue
+			}
+			for sl := 0; sl < s.opts.SlotsPerSchedule; sl++ {
+				id := SlotId(l, sc, sl)
+				at, ok := booked[id]
+				if !since.IsZero() && !at.After(since) {
+					continue
+				}
+				status := "free"
+				if ok {
+					status = "busy"
+				}
+				start := s.opts.FirstSlotStart.Add(time.Duration(sl) * time.Hour)
+				if !emit(s.slot(id, ScheduleId(l, sc), status, start)) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// hugeSlots emits slots of the first schedule until about HugeFileBytes were emitted.
+func (s *Server) hugeSlots(emit func(v interface{}) bool) {
+	var written int64
+	for i := int64(0); written < s.opts.HugeFileBytes; i++ {
+		v := s.slot(fmt.Sprintf("huge-slot-%d", i), ScheduleId(0, 0), "free", s.opts.FirstSlotStart.Add(time.Duration(i)*time.Minute))
+		b, _ := json.Marshal(v)
+		written += int64(len(b)) + 1
+		if !emit(v) {
+			return
+		}
+	}
+}
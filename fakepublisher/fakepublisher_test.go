@@ -0,0 +1,224 @@
+package fakepublisher_test
+
+import (
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/lazau/scheduling-links-aggregator/fakepublisher"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// The crawler and parser binaries, built by TestMain.
+var crawlerBin, parserBin string
+
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir("", "fakepublisher_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	crawlerBin = filepath.Join(dir, "crawler")
+	parserBin = filepath.Join(dir, "parser")
+	goBin := filepath.Join(runtime.GOROOT(), "bin", "go")
+	for bin, pkg := range map[string]string{
+		crawlerBin: "github.com/lazau/scheduling-links-aggregator/crawler",
+		parserBin:  "github.com/lazau/scheduling-links-aggregator/parser",
+	} {
+		if out, err := exec.Command(goBin, "build", "-o", bin, pkg).CombinedOutput(); err != nil {
+			os.RemoveAll(dir)
+			log.Fatalf("go build %s failed: %s\n%s", pkg, err, out)
+		}
+	}
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// run runs bin with args, failing the test if it fails.
+func run(t *testing.T, bin string, args ...string) {
+	out, err := exec.Command(bin, args...).CombinedOutput()
+	if err != nil {
+		t.Fatalf("%s failed: %s\n%s", filepath.Base(bin), err, out)
+	}
+}
+
+// crawl crawls manifestUrl with the crawler and returns its output.
+func crawl(t *testing.T, manifestUrl string, flags ...string) *sql.DB {
+	dir := t.TempDir()
+	manifestUrls := filepath.Join(dir, "manifest_urls")
+	if err := ioutil.WriteFile(manifestUrls, []byte(manifestUrl+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	output := filepath.Join(dir, "crawler_output.sqlite")
+	run(t, crawlerBin, append([]string{
+		"--manifest_urls=" + manifestUrls,
+		"--output=" + output,
+		"--latest=",
+		"--cache_dir=",
+		"--allow_private_addresses",
+		"--host_max_qps=0",
+		"--retry_base_delay=1ms",
+	}, flags...)...)
+	return openDatabase(t, output)
+}
+
+// parse parses the crawler output crawlerOutput with the parser and returns its output.
+func parse(t *testing.T, crawlerOutput string) *sql.DB {
+	output := filepath.Join(t.TempDir(), "parser_output.sqlite")
+	run(t, parserBin, "--crawler_output_file="+crawlerOutput, "--output="+output, "--latest=")
+	return openDatabase(t, output)
+}
+
+func openDatabase(t *testing.T, filename string) *sql.DB {
+	db, err := sql.Open("sqlite3", filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// filename returns the file db was opened from.
+func filename(t *testing.T, db *sql.DB) string {
+	var seq int
+	var name, file string
+	if err := db.QueryRow("PRAGMA database_list").Scan(&seq, &name, &file); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+// count returns the result of a COUNT(*) query.
+func count(t *testing.T, db *sql.DB, query string, args ...interface{}) int {
+	var n int
+	if err := db.QueryRow(query, args...).Scan(&n); err != nil {
+		t.Fatalf("%s: %s", query, err)
+	}
+	return n
+}
+
+type countCheck struct {
+	query string
+	args  []interface{}
+	want  int
+}
+
+func checkCounts(t *testing.T, db *sql.DB, checks []countCheck) {
+	for _, c := range checks {
+		if got := count(t, db, c.query, c.args...); got != c.want {
+			t.Errorf("%s %v = %d, want %d", c.query, c.args, got, c.want)
+		}
+	}
+}
+
+func TestCrawlAndParse(t *testing.T) {
+	s := fakepublisher.NewServer(fakepublisher.Options{
+		Locations:            4,
+		SchedulesPerLocation: 2,
+		SlotsPerSchedule:     3,
+		SlotFiles:            3,
+		Errors:               map[string]int{"/slots-2.ndjson": 404},
+		// Each fetch is redirected twice, and the first fetch fails.
+		Redirects: map[string]int{"/slots-1.ndjson": 2},
+		FailFirst: map[string]int{"/slots-1.ndjson": 1},
+		Delays:    map[string]time.Duration{"/schedules.ndjson": 100 * time.Millisecond},
+		// Malforms the 5th line of each file: the schedule of location 2, and a slot in each slot file.
+		MalformedLineEvery: 5,
+		HugeFileBytes:      3 << 20,
+	})
+	defer s.Close()
+
+	crawlerOutput := crawl(t, s.ManifestUrl(), "--storage=lines", "--max_response_bytes=slot=1MiB", "--max_attempts=2")
+	hugeUrl := s.URL + fakepublisher.HugeSlotsPath
+	checkCounts(t, crawlerOutput, []countCheck{
+		{"SELECT COUNT(*) FROM crawl_runs WHERE status = 'complete'", nil, 1},
+		{"SELECT COUNT(*) FROM locations", nil, 1},
+		{"SELECT COUNT(*) FROM schedules", nil, 1},
+		// slots-0 and slots-1. slots-2 fails, and huge.ndjson is too large.
+		{"SELECT COUNT(*) FROM slots WHERE sha256 <> ''", nil, 2},
+		{"SELECT COUNT(*) FROM slots WHERE url = ?", []interface{}{hugeUrl}, 0},
+		{"SELECT COUNT(*) FROM slots WHERE final_url LIKE '%/slots-1.ndjson?hop=2'", nil, 1},
+		{"SELECT COUNT(*) FROM crawl_errors WHERE url = ? AND error_class = 'http_4xx' AND attempts = 1",
+			[]interface{}{s.URL + "/slots-2.ndjson"}, 1},
+		{"SELECT COUNT(*) FROM crawl_errors WHERE url = ? AND error_class = 'too_large'", []interface{}{hugeUrl}, 1},
+		{"SELECT COUNT(*) FROM crawl_errors", nil, 2},
+	})
+	// Two fetches of three requests each.
+	if n := s.Requests("/slots-1.ndjson"); n != 6 {
+		t.Errorf("Requests(/slots-1.ndjson) = %d, want 6", n)
+	}
+
+	parserOutput := parse(t, filename(t, crawlerOutput))
+	checkCounts(t, parserOutput, []countCheck{
+		{"SELECT COUNT(*) FROM locations", nil, 4},
+		{"SELECT COUNT(*) FROM schedules WHERE location_id IS NOT NULL", nil, 7},
+		{"SELECT COUNT(*) FROM schedules WHERE id = ?", []interface{}{fakepublisher.ScheduleId(2, 0)}, 0},
+		// 9 slots in each of slots-0 and slots-1, less one malformed slot each.
+		{"SELECT COUNT(*) FROM slots", nil, 16},
+		{"SELECT COUNT(*) FROM slots WHERE id LIKE 'huge-slot-%'", nil, 0},
+		{"SELECT COUNT(*) FROM parse_errors WHERE kind = 'malformed_json' AND resource_type = 'Schedule'", nil, 1},
+		{"SELECT COUNT(*) FROM parse_errors WHERE kind = 'malformed_json' AND resource_type = 'Slot'", nil, 2},
+		{"SELECT COUNT(*) FROM parse_errors", nil, 3},
+		// The remaining slots of the malformed schedule.
+		{"SELECT COUNT(*) FROM dangling_references WHERE reason = 'unknown'", nil, 2},
+		{"SELECT COUNT(*) FROM slot_extensions", nil, 3 * 16},
+	})
+}
+
+func TestCrawlReadTimeout(t *testing.T) {
+	s := fakepublisher.NewServer(fakepublisher.Options{
+		SlotsPerSchedule: 10,
+		Stalls:           map[string]time.Duration{"/slots-0.ndjson": time.Minute},
+	})
+	defer s.Close()
+
+	crawlerOutput := crawl(t, s.ManifestUrl(), "--read_timeout=200ms", "--max_attempts=3")
+	slotsUrl := s.URL + fmt.Sprintf(fakepublisher.SlotsPathFormat, 0)
+	checkCounts(t, crawlerOutput, []countCheck{
+		{"SELECT COUNT(*) FROM locations", nil, 1},
+		{"SELECT COUNT(*) FROM schedules", nil, 1},
+		{"SELECT COUNT(*) FROM slots", nil, 0},
+		{"SELECT COUNT(*) FROM crawl_errors WHERE url = ? AND error_class = 'timeout' AND attempts = 3",
+			[]interface{}{slotsUrl}, 1},
+	})
+	if n := s.Requests("/slots-0.ndjson"); n != 3 {
+		t.Errorf("Requests(/slots-0.ndjson) = %d, want 3", n)
+	}
+}
+
+func TestIncrementalCrawl(t *testing.T) {
+	s := fakepublisher.NewServer(fakepublisher.Options{Locations: 2, SlotsPerSchedule: 3})
+	defer s.Close()
+	previous := crawl(t, s.ManifestUrl())
+
+	// The delta slots-0.ndjson has the same URL as the previous one, but only holds 2 of its 6 slots.
+	booked := []string{fakepublisher.SlotId(0, 0, 1), fakepublisher.SlotId(1, 0, 2)}
+	s.Book(time.Date(2021, 4, 1, 12, 0, 0, 0, time.UTC), booked...)
+	crawlerOutput := crawl(t, s.ManifestUrl(), "--incremental", "--previous_output="+filename(t, previous))
+	slotsUrl := s.URL + fmt.Sprintf(fakepublisher.SlotsPathFormat, 0)
+	checkCounts(t, crawlerOutput, []countCheck{
+		{"SELECT COUNT(*) FROM manifests WHERE since IS NOT NULL", nil, 1},
+		{"SELECT COUNT(*) FROM locations", nil, 1},
+		{"SELECT COUNT(*) FROM schedules", nil, 1},
+		// The previous file, and the delta beside it.
+		{"SELECT COUNT(*) FROM slots WHERE url = ?", []interface{}{slotsUrl}, 2},
+		{"SELECT COUNT(*) FROM slots s JOIN manifests m USING (manifest_id) WHERE s.fetch_start_ms < m.fetch_start_ms", nil, 1},
+	})
+
+	parserOutput := parse(t, filename(t, crawlerOutput))
+	checkCounts(t, parserOutput, []countCheck{
+		{"SELECT COUNT(*) FROM locations", nil, 2},
+		{"SELECT COUNT(*) FROM schedules", nil, 2},
+		{"SELECT COUNT(*) FROM slots", nil, 6},
+		{"SELECT COUNT(*) FROM slots WHERE status = 'busy' AND id IN (?, ?)", []interface{}{booked[0], booked[1]}, 2},
+		{"SELECT COUNT(*) FROM slots WHERE status = 'free'", nil, 4},
+		{"SELECT COUNT(*) FROM parse_errors", nil, 0},
+	})
+}
@@ -2,4 +2,7 @@ module github.com/lazau/scheduling-links-aggregator
 
 go 1.16
 
-require github.com/mattn/go-sqlite3 v1.14.7 // indirect
+require (
+	github.com/klauspost/compress v1.13.6
+	github.com/mattn/go-sqlite3 v1.14.7
+)
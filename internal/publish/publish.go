@@ -0,0 +1,56 @@
+// Package publish atomically publishes the crawler's and parser's output files, so that consumers never
+// read an incomplete output.
+package publish
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// PartialSuffix is appended to the name of an output file while it is being written, so that
+// consumers never read an incomplete output.
+const PartialSuffix = ".partial"
+
+// Output checks the integrity of odb, the output being written into filename+PartialSuffix,
+// closes it, and atomically renames it to filename. If latest is not empty, the symlink latest is
+// then updated to point at filename.
+func Output(odb *sql.DB, filename, latest string) error {
+	partial := filename + PartialSuffix
+	// integrity_check returns a single "ok" row, or rows describing each problem found.
+	var result string
+	if err := odb.QueryRow("PRAGMA integrity_check").Scan(&result); err != nil {
+		odb.Close()
+		return err
+	}
+	if result != "ok" {
+		odb.Close()
+		return fmt.Errorf("integrity check of %s failed: %s", partial, result)
+	}
+	if err := odb.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(partial, filename); err != nil {
+		return err
+	}
+	if latest == "" {
+		return nil
+	}
+	return UpdateLatest(latest, filename)
+}
+
+// UpdateLatest atomically replaces the symlink latest with a symlink to filename.
+func UpdateLatest(latest, filename string) error {
+	target, err := filepath.Abs(filename)
+	if err != nil {
+		return err
+	}
+	tmp := latest + PartialSuffix
+	_ = os.Remove(tmp)
+	if err := os.Symlink(target, tmp); err != nil {
+		return err
+	}
+	return os.Rename(tmp, latest)
+}
@@ -1,23 +1,35 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"path/filepath"
-	"sort"
 	"strings"
 	"time"
 
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/klauspost/compress/zstd"
+	"github.com/lazau/scheduling-links-aggregator/internal/publish"
+	"github.com/mattn/go-sqlite3"
 )
 
 var (
-	crawlerOutputFile = flag.String("crawler_output_file", "", "The output file produced by the crawler. If empty, finds the latest crawler output matching '/tmp/crawler_output.*.sqlite'.")
-	output            = flag.String("output", "/tmp/parser_output.VERSION.sqlite", "The output file. 'VERSION' is replaced by the current unix epoch timestamp.")
+	crawlerOutputFile   = flag.String("crawler_output_file", "", "The output file produced by the crawler. If empty, parses the crawler output --latest_crawler_output points at.")
+	latestCrawlerOutput = flag.String("latest_crawler_output", "/tmp/crawler_output.latest", "The symlink the crawler updates to point at its latest output. See the crawler's --latest.")
+	output              = flag.String("output", "/tmp/parser_output.VERSION.sqlite", "The output file. 'VERSION' is replaced by the current unix epoch timestamp. The output is written into the file suffixed with '.partial', and renamed to the output file once complete.")
+	latest              = flag.String("latest", "/tmp/parser_output.latest", "A symlink updated to point at the output file once it is complete and published. Empty disables.")
+	maxLineBytes        = flag.Int("max_line_bytes", 16*1024*1024, "The maximum length of a single line of a crawled file.")
+	crawlRunId          = flag.Int64("crawl_run_id", 0, "The crawl run in the crawler output to parse. If 0, parses the latest complete crawl run.")
+	strict              = flag.Bool("strict", false, "If true, fails without publishing the output if the fraction of lines with parse errors exceeds --max_error_rate. See the output's parse_errors table.")
+	maxErrorRate        = flag.Float64("max_error_rate", 0.01, "The maximum fraction of lines with parse errors allowed by --strict.")
 )
 
 // OutputSchema is the schema for the sqlite database written into the output file.
@@ -34,6 +46,17 @@ PRAGMA foreign_keys = ON;
 -- In general, fields are renamed from camelCase to snake_case.
 -- Arrays fields are stored in a FILE-TYPE_FIELD table, and joined using the FILE-TYPE's primary key.
 -- E.g. the array of telecom JSON objects in Location is stored in location_telecoms and joined on location_id.
+--
+-- Resource ids are only unique within the manifest listing them. References between resources, e.g.
+-- Schedule.actor, are resolved within the manifest into foreign keys, e.g. schedules.location_id.
+-- References which cannot be resolved are recorded in dangling_references.
+--
+-- Every Location, Schedule, and Slot records where it was parsed from: its publisher, manifest, file,
+-- and line. (publisher, id) is unique; resources whose id duplicates an earlier resource of the same
+-- publisher are skipped. Manifests are read in the order they were crawled, and the files of each
+-- manifest newest first, so the most recently fetched copy of a resource is kept. Files fetched by an
+-- incremental crawl are read before the previous crawl's files copied beside them, whose resources
+-- with the same id are superseded rather than duplicates.
 
 -- A Location object.
 -- https://github.com/smart-on-fhir/smart-scheduling-links/blob/master/specification.md#location-file
@@ -41,13 +64,31 @@ CREATE TABLE locations(
     location_id INTEGER PRIMARY KEY,
 
     -- Note that since we aggregate data from multiple publishers, id
-    -- is not guaranteed to be unique like the spec says.
+    -- is only unique per publisher.
     id TEXT NOT NULL,
     name TEXT NOT NULL,
 
-    description TEXT NOT NULL
+    description TEXT NOT NULL,
+
+    -- The manifest_id, in the crawler output, of the manifest listing the file the resource was parsed from.
+    manifest_id INTEGER NOT NULL,
+
+    -- Provenance.
+    -- The name of the publisher, as in the crawler output's publishers table.
+    publisher TEXT NOT NULL,
+    -- The URL of the manifest listing the file the resource was parsed from.
+    manifest_url TEXT NOT NULL,
+    -- The URL of the file the resource was parsed from, and the resource's 1-based line number in it.
+    file_url TEXT NOT NULL,
+    line_number INTEGER NOT NULL,
+    -- When the file was fetched by the crawler, as milliseconds since Unix epoch.
+    crawl_time_ms INTEGER NOT NULL,
+
+    UNIQUE (publisher, id)
 );
 
+CREATE INDEX locations_manifest_id_id ON locations(manifest_id, id);
+
 -- Location.telecom object.
 CREATE TABLE location_telecoms(
     location_telecom_id INTEGER PRIMARY KEY,
@@ -107,24 +148,57 @@ CREATE TABLE schedules(
     schedule_id INTEGER PRIMARY KEY,
 
     -- Note that since we aggregate data from multiple publishers, id
-    -- is not guaranteed to be unique like the spec says.
+    -- is only unique per publisher.
     id TEXT NOT NULL,
 
     -- Although actor is a JSON array. It can only have one object with a string "reference" field.
     -- We put the reference string here directly instead of another child table.
-    actor_reference TEXT NOT NULL
+    actor_reference TEXT NOT NULL,
+
+    -- The location actor_reference refers to. NULL if the reference is dangling.
+    location_id
+      REFERENCES locations(location_id)
+        ON DELETE SET NULL,
+
+    -- See locations.manifest_id.
+    manifest_id INTEGER NOT NULL,
+
+    -- Provenance. See the locations table.
+    publisher TEXT NOT NULL,
+    manifest_url TEXT NOT NULL,
+    file_url TEXT NOT NULL,
+    line_number INTEGER NOT NULL,
+    crawl_time_ms INTEGER NOT NULL,
+
+    UNIQUE (publisher, id)
 );
 
--- Schedule.serviceType object.
+CREATE INDEX schedules_manifest_id_id ON schedules(manifest_id, id);
+CREATE INDEX schedules_location_id ON schedules(location_id);
+
+-- Schedule.serviceType object, a CodeableConcept.
+-- https://www.hl7.org/fhir/datatypes.html#CodeableConcept
 CREATE TABLE schedule_service_types(
     schedule_service_type_id INTEGER PRIMARY KEY,
 
+    -- NULL if absent.
+    text TEXT,
+
+    schedule_id NOT NULL
+      REFERENCES schedules(schedule_id)
+        ON DELETE CASCADE
+);
+
+-- Schedule.serviceType.coding object.
+CREATE TABLE schedule_service_type_codings(
+    schedule_service_type_coding_id INTEGER PRIMARY KEY,
+
     system TEXT NOT NULL,
     code TEXT NOT NULL,
     display TEXT NOT NULL,
 
-    schedule_id NOT NULL
-      REFERENCES schedules(schedule_id)
+    schedule_service_type_id NOT NULL
+      REFERENCES schedule_service_types(schedule_service_type_id)
         ON DELETE CASCADE
 );
 
@@ -155,22 +229,50 @@ CREATE TABLE slots(
     slot_id INTEGER PRIMARY KEY,
 
     -- Note that since we aggregate data from multiple publishers, id
-    -- is not guaranteed to be unique like the spec says.
+    -- is only unique per publisher.
     id TEXT NOT NULL,
 
     -- Although schedule is a JSON object, it can only have one string "reference" field.
     -- We put the reference string here directly instead of another child table.
     schedule_reference TEXT NOT NULL,
 
+    -- The schedule schedule_reference refers to. NULL if the reference is dangling.
+    schedule_id
+      REFERENCES schedules(schedule_id)
+        ON DELETE SET NULL,
+
     status TEXT NOT NULL,
 
     -- 'start' field as seconds since Unix epoch.
     start_sec INTEGER NOT NULL,
 
-    -- 'end' field as seconds since Unix epoch.
-    end_sec INTEGER NOT NULL
+    -- 'start' field's UTC offset in seconds, e.g. -18000 for "-05:00", and its date in that
+    -- offset, e.g. "2021-03-01", i.e. the location's local time as given by the publisher.
+    start_utc_offset_sec INTEGER NOT NULL,
+    start_local_date TEXT NOT NULL,
+
+    -- 'end' field as seconds since Unix epoch. Never before start_sec.
+    end_sec INTEGER NOT NULL,
+
+    -- See start_utc_offset_sec and start_local_date.
+    end_utc_offset_sec INTEGER NOT NULL,
+    end_local_date TEXT NOT NULL,
+
+    -- See locations.manifest_id.
+    manifest_id INTEGER NOT NULL,
+
+    -- Provenance. See the locations table.
+    publisher TEXT NOT NULL,
+    manifest_url TEXT NOT NULL,
+    file_url TEXT NOT NULL,
+    line_number INTEGER NOT NULL,
+    crawl_time_ms INTEGER NOT NULL,
+
+    UNIQUE (publisher, id)
 );
 
+CREATE INDEX slots_schedule_id ON slots(schedule_id);
+
 -- Slot.extension object.
 CREATE TABLE slot_extensions(
     slot_extension_id INTEGER PRIMARY KEY,
@@ -193,6 +295,84 @@ CREATE TABLE slot_extensions(
       REFERENCES slots(slot_id)
         ON DELETE CASCADE
 );
+
+-- Slots which were not written to the slots table because their start or end is not a FHIR instant
+-- (https://www.hl7.org/fhir/datatypes.html#instant), or their end is before their start.
+CREATE TABLE rejected_slots(
+    rejected_slot_id INTEGER PRIMARY KEY,
+
+    id TEXT NOT NULL,
+    schedule_reference TEXT NOT NULL,
+
+    -- The 'start' and 'end' fields as given by the publisher.
+    raw_start TEXT NOT NULL,
+    raw_end TEXT NOT NULL,
+
+    -- The offending field, "start" or "end", and what is wrong with it.
+    field TEXT NOT NULL,
+    message TEXT NOT NULL,
+
+    -- See the slots table.
+    manifest_id INTEGER NOT NULL,
+    publisher TEXT NOT NULL,
+    manifest_url TEXT NOT NULL,
+    file_url TEXT NOT NULL,
+    line_number INTEGER NOT NULL,
+    crawl_time_ms INTEGER NOT NULL
+);
+
+-- Problems with lines of Location, Schedule, and Slot files, to be reported to publishers.
+CREATE TABLE parse_errors(
+    parse_error_id INTEGER PRIMARY KEY,
+
+    -- "Location", "Schedule", or "Slot".
+    resource_type TEXT NOT NULL,
+
+    -- The kind of error:
+    -- "malformed_json": the line is not a JSON resource. The line is skipped.
+    -- "missing_field": a required field, e.g. Schedule.actor, is missing. The resource is skipped.
+    -- "duplicate_id": the publisher has an earlier resource with the same id. The resource is skipped.
+    -- "invalid_time": see the rejected_slots table. The resource is skipped.
+    -- "unknown_extension": an extension's url is not recognized. The extension is skipped.
+    kind TEXT NOT NULL,
+
+    -- What is wrong with the line.
+    message TEXT NOT NULL,
+
+    -- The line, as crawled.
+    raw_line TEXT NOT NULL,
+
+    -- See the locations table.
+    manifest_id INTEGER NOT NULL,
+    publisher TEXT NOT NULL,
+    manifest_url TEXT NOT NULL,
+    file_url TEXT NOT NULL,
+    line_number INTEGER NOT NULL,
+    crawl_time_ms INTEGER NOT NULL
+);
+
+-- References between resources which could not be resolved within their manifest.
+CREATE TABLE dangling_references(
+    dangling_reference_id INTEGER PRIMARY KEY,
+
+    -- The resource with the dangling reference. Exactly one is not NULL.
+    schedule_id
+      REFERENCES schedules(schedule_id)
+        ON DELETE CASCADE,
+    slot_id
+      REFERENCES slots(slot_id)
+        ON DELETE CASCADE,
+
+    -- The reference, e.g. "Location/123".
+    reference TEXT NOT NULL,
+
+    -- "malformed" if the reference isn't of the form "Location/" + id or "Schedule/" + id, or
+    -- "unknown" if the manifest lists no resource with the referenced id.
+    reason TEXT NOT NULL,
+
+    -- See locations.manifest_id.
+    manifest_id INTEGER NOT NULL
+);
 `
 
 /* File Object Models */
@@ -269,14 +449,22 @@ type ScheduleFileActor struct {
 	Reference string `json:"reference"`
 }
 
-// ScheduleFileServiceType is the `serviceType` JSON object in the schedule file, as defined
+// ScheduleFileServiceTypeCoding is the `serviceType.coding` JSON object in the schedule file, as defined
 // https://github.com/smart-on-fhir/smart-scheduling-links/blob/master/specification.md#schedule-file
-type ScheduleFileServiceType struct {
+type ScheduleFileServiceTypeCoding struct {
 	System  string `json:"system"`
 	Code    string `json:"code"`
 	Display string `json:"display"`
 }
 
+// ScheduleFileServiceType is the `serviceType` JSON object in the schedule file, a FHIR CodeableConcept, as defined
+// https://github.com/smart-on-fhir/smart-scheduling-links/blob/master/specification.md#schedule-file
+// and https://www.hl7.org/fhir/datatypes.html#CodeableConcept
+type ScheduleFileServiceType struct {
+	Coding []ScheduleFileServiceTypeCoding `json:"coding"`
+	Text   *string                         `json:"text"`
+}
+
 // ScheduleFileExtensionValueCoding is the `valueCoding` JSON object in the schedule file, as defined
 // https://github.com/smart-on-fhir/smart-scheduling-links/blob/master/specification.md#schedule-file
 type ScheduleFileExtensionValueCoding struct {
@@ -336,6 +524,153 @@ type SlotFile struct {
    Invalid data is silently dropped.
 */
 
+// CrawledFile is a Location, Schedule, or Slot file in the crawler output.
+type CrawledFile struct {
+	// The manifest_id of the manifest listing the file. Resource references are resolved within it.
+	ManifestId int64
+
+	// The URL of the file.
+	Url string
+
+	// The name of the publisher of the manifest listing the file.
+	Publisher string
+
+	// The URL of the manifest listing the file.
+	ManifestUrl string
+
+	// When the file was fetched, as milliseconds since Unix epoch.
+	FetchStartMs int64
+
+	// Whether the file was copied from a previous crawl by an incremental crawl. Its resources are
+	// superseded by those of the same id in files fetched by the crawl, which are read first.
+	Previous bool
+}
+
+// ParsedLine is a line of a CrawledFile, holding a single resource.
+type ParsedLine struct {
+	File *CrawledFile
+
+	// The line's 1-based line number in File.
+	Number int
+
+	// The line's contents.
+	Contents []byte
+
+	// "Location", "Schedule", or "Slot".
+	ResourceType string
+
+	// The kinds of the parse errors WriteParseError recorded for the line.
+	ErrorKinds []string
+}
+
+// Kinds of ParseError.
+const (
+	ParseErrorMalformedJson    = "malformed_json"
+	ParseErrorMissingField     = "missing_field"
+	ParseErrorDuplicateId      = "duplicate_id"
+	ParseErrorInvalidTime      = "invalid_time"
+	ParseErrorUnknownExtension = "unknown_extension"
+)
+
+// ParseError is a problem with a resource, which is recorded in the parse_errors table rather than
+// failing the parse.
+type ParseError struct {
+	Kind    string
+	Message string
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Kind, e.Message)
+}
+
+// WriteParseError records err in the parse_errors table and returns nil if err is a *ParseError about
+// line. Otherwise returns err.
+func WriteParseError(db *sql.DB, line *ParsedLine, err error) error {
+	parseErr, ok := err.(*ParseError)
+	if !ok {
+		return err
+	}
+	log.Printf("Parse error in %s at %s:%d - %s.", line.ResourceType, line.File.Url, line.Number, parseErr)
+	line.ErrorKinds = append(line.ErrorKinds, parseErr.Kind)
+	_, err = db.Exec(`INSERT INTO
+      parse_errors (resource_type, kind, message, raw_line, manifest_id,
+                    publisher, manifest_url, file_url, line_number, crawl_time_ms)
+      VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		line.ResourceType, parseErr.Kind, parseErr.Message, string(line.Contents), line.File.ManifestId,
+		line.File.Publisher, line.File.ManifestUrl, line.File.Url, line.Number, line.File.FetchStartMs)
+	return err
+}
+
+// isDuplicateResource returns whether err is the failure to write a resource whose id is already
+// used by another resource of the same publisher.
+func isDuplicateResource(err error) bool {
+	var sqliteErr sqlite3.Error
+	return errors.As(err, &sqliteErr) && sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique
+}
+
+// duplicateResourceError returns the error for the resource with id parsed from line, whose id was
+// already written. Returns nil if the resource was superseded by a newer version, which is not an error.
+func duplicateResourceError(line *ParsedLine, id string) error {
+	if line.File.Previous {
+		return nil
+	}
+	return &ParseError{Kind: ParseErrorDuplicateId, Message: fmt.Sprintf("duplicate id '%s'", id)}
+}
+
+/* Reference Resolution */
+
+// Reasons recorded in the dangling_references table.
+const (
+	DanglingReferenceMalformed = "malformed"
+	DanglingReferenceUnknown   = "unknown"
+)
+
+// ReferenceId returns the id of the resource of resourceType that reference refers to, e.g. "123" for
+// ReferenceId("Location/123", "Location"). Absolute references such as
+// "https://example.com/fhir/Location/123" are accepted. Returns false if reference is malformed.
+func ReferenceId(reference, resourceType string) (string, bool) {
+	prefix := resourceType + "/"
+	i := strings.LastIndex(reference, prefix)
+	if i < 0 || (i > 0 && reference[i-1] != '/') {
+		return "", false
+	}
+	id := reference[i+len(prefix):]
+	if id == "" || strings.Contains(id, "/") {
+		return "", false
+	}
+	return id, true
+}
+
+// ResolveReference returns the primary key of the resource of resourceType that reference refers to,
+// looked up in table among the resources listed by manifestId. If the reference is dangling, returns
+// nil and the reason.
+func ResolveReference(db *sql.DB, table, idColumn, resourceType, reference string, manifestId int64) (interface{}, string, error) {
+	id, ok := ReferenceId(reference, resourceType)
+	if !ok {
+		return nil, DanglingReferenceMalformed, nil
+	}
+	var rowId int64
+	err := db.QueryRow(
+		fmt.Sprintf("SELECT %s FROM %s WHERE manifest_id = ? AND id = ? ORDER BY %s LIMIT 1", idColumn, table, idColumn),
+		manifestId, id).Scan(&rowId)
+	if err == sql.ErrNoRows {
+		return nil, DanglingReferenceUnknown, nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	return rowId, "", nil
+}
+
+// WriteDanglingReference records that the row rowId of the table with primary key idColumn has a
+// dangling reference.
+func WriteDanglingReference(db *sql.DB, idColumn string, rowId int64, reference, reason string, manifestId int64) error {
+	_, err := db.Exec(
+		fmt.Sprintf("INSERT INTO dangling_references (%s, reference, reason, manifest_id) VALUES (?, ?, ?, ?)", idColumn),
+		rowId, reference, reason, manifestId)
+	return err
+}
+
 /* Location File Serialization */
 // Serializes LocationFileTelecom and writes to the location_telecoms table.
 func (l *LocationFileTelecom) Write(db *sql.DB, locationId int64) error {
@@ -376,11 +711,17 @@ func (l *LocationFileIdentifier) Write(db *sql.DB, locationId int64) error {
 	return err
 }
 
-// Serializes LocationFile and writes to the locations table.
-func (l *LocationFile) Write(db *sql.DB) error {
-	res, err := db.Exec(
-		"INSERT INTO locations (id, name, description) VALUES (?, ?, ?)",
-		l.Id, l.Name, l.Description)
+// Serializes LocationFile, parsed from line, and writes to the locations table.
+func (l *LocationFile) Write(db *sql.DB, line *ParsedLine) error {
+	file := line.File
+	res, err := db.Exec(`INSERT INTO
+      locations (id, name, description, manifest_id, publisher, manifest_url, file_url, line_number, crawl_time_ms)
+      VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		l.Id, l.Name, l.Description, file.ManifestId,
+		file.Publisher, file.ManifestUrl, file.Url, line.Number, file.FetchStartMs)
+	if isDuplicateResource(err) {
+		return duplicateResourceError(line, l.Id)
+	}
 	if err != nil {
 		return err
 	}
@@ -429,34 +770,66 @@ func (s *ScheduleFileExtension) Write(db *sql.DB, scheduleId int64) error {
 			s.Url, s.ValueCoding.System, s.ValueCoding.Code, s.ValueCoding.Display, scheduleId)
 		return err
 	} else {
-		log.Print("Ignoring invalid ScheduleFileExtension - unrecognized Url: %#v", s)
 		// Invalid Extension - do not write.
-		return nil
+		return &ParseError{Kind: ParseErrorUnknownExtension, Message: fmt.Sprintf("unrecognized extension url '%s'", s.Url)}
 	}
 }
 
 // Serializes ScheduleFileServiceType and writes to the schedule_service_types table.
 func (s *ScheduleFileServiceType) Write(db *sql.DB, scheduleId int64) error {
+	res, err := db.Exec(
+		"INSERT INTO schedule_service_types (text, schedule_id) VALUES (?, ?)",
+		s.Text, scheduleId)
+	if err != nil {
+		return err
+	}
+
+	serviceTypeId, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+
+	for _, v := range s.Coding {
+		if err := v.Write(db, serviceTypeId); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Serializes ScheduleFileServiceTypeCoding and writes to the schedule_service_type_codings table.
+func (s *ScheduleFileServiceTypeCoding) Write(db *sql.DB, serviceTypeId int64) error {
 	_, err := db.Exec(
-		`INSERT INTO schedule_service_types
-        (system, code, display, schedule_id)
+		`INSERT INTO schedule_service_type_codings
+        (system, code, display, schedule_service_type_id)
       VALUES (?, ?, ?, ?)`,
-		s.System, s.Code, s.Display, scheduleId)
+		s.System, s.Code, s.Display, serviceTypeId)
 	return err
 }
 
-// Serializes ScheduleFile and writes to the schedules table.
-func (s *ScheduleFile) Write(db *sql.DB) error {
+// Serializes ScheduleFile, parsed from line, and writes to the schedules table.
+// Locations must be written first, so that the schedule's actor can be resolved.
+func (s *ScheduleFile) Write(db *sql.DB, line *ParsedLine) error {
+	file := line.File
 	// Actor must be an array with a single object containing a JSON object with the
 	// field 'reference'.
 	if len(s.Actor) == 0 {
-		log.Print("Ignoring bad ScheduleFile - missing actor.reference: %#v", s)
-		return nil
+		return &ParseError{Kind: ParseErrorMissingField, Message: "missing actor.reference"}
 	}
 
-	res, err := db.Exec(
-		"INSERT INTO schedules (id, actor_reference) VALUES (?, ?)",
-		s.Id, s.Actor[0].Reference)
+	locationId, dangling, err := ResolveReference(db, "locations", "location_id", "Location", s.Actor[0].Reference, file.ManifestId)
+	if err != nil {
+		return err
+	}
+
+	res, err := db.Exec(`INSERT INTO
+      schedules (id, actor_reference, location_id, manifest_id, publisher, manifest_url, file_url, line_number, crawl_time_ms)
+      VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		s.Id, s.Actor[0].Reference, locationId, file.ManifestId,
+		file.Publisher, file.ManifestUrl, file.Url, line.Number, file.FetchStartMs)
+	if isDuplicateResource(err) {
+		return duplicateResourceError(line, s.Id)
+	}
 	if err != nil {
 		return err
 	}
@@ -466,6 +839,12 @@ func (s *ScheduleFile) Write(db *sql.DB) error {
 		return err
 	}
 
+	if dangling != "" {
+		if err := WriteDanglingReference(db, "schedule_id", scheduleId, s.Actor[0].Reference, dangling, file.ManifestId); err != nil {
+			return err
+		}
+	}
+
 	for _, v := range s.ServiceType {
 		if err := v.Write(db, scheduleId); err != nil {
 			return err
@@ -473,7 +852,7 @@ func (s *ScheduleFile) Write(db *sql.DB) error {
 	}
 
 	for _, v := range s.Extension {
-		if err := v.Write(db, scheduleId); err != nil {
+		if err := WriteParseError(db, line, v.Write(db, scheduleId)); err != nil {
 			return err
 		}
 	}
@@ -483,9 +862,36 @@ func (s *ScheduleFile) Write(db *sql.DB) error {
 
 /* Slot File Serialization */
 
-const (
-	ISO8601TimeFormat = "2006-01-02T15:04:05Z0700"
-)
+// InstantFormats are the layouts of FHIR instants, e.g. "2021-03-01T13:00:00.000-05:00".
+// See https://www.hl7.org/fhir/datatypes.html#instant. Fractional seconds are optional.
+// Offsets without a colon, e.g. "-0500", are accepted too, since some publishers use them.
+var InstantFormats = []string{time.RFC3339, "2006-01-02T15:04:05Z0700"}
+
+// ParseInstant parses the FHIR instant s. The returned time keeps s's UTC offset.
+func ParseInstant(s string) (time.Time, error) {
+	for _, format := range InstantFormats {
+		if t, err := time.Parse(format, s); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("cannot be parsed as a FHIR instant. Got '%s'", s)
+}
+
+// WriteRejected writes SlotFile, parsed from line, to the rejected_slots table, and returns the
+// *ParseError to record for it. field is the offending field, and message what is wrong with it.
+func (s *SlotFile) WriteRejected(db *sql.DB, line *ParsedLine, field, message string) error {
+	file := line.File
+	_, err := db.Exec(`INSERT INTO
+      rejected_slots (id, schedule_reference, raw_start, raw_end, field, message, manifest_id,
+                      publisher, manifest_url, file_url, line_number, crawl_time_ms)
+      VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		s.Id, s.Schedule.Reference, s.Start, s.End, field, message, file.ManifestId,
+		file.Publisher, file.ManifestUrl, file.Url, line.Number, file.FetchStartMs)
+	if err != nil {
+		return err
+	}
+	return &ParseError{Kind: ParseErrorInvalidTime, Message: fmt.Sprintf("%s %s", field, message)}
+}
 
 // Serializes SlotFileExtension and writes to the slot_extensions table.
 func (s *SlotFileExtension) Write(db *sql.DB, slotId int64) error {
@@ -509,29 +915,45 @@ func (s *SlotFileExtension) Write(db *sql.DB, slotId int64) error {
 		return err
 	} else {
 		// Invalid Extension - do not write.
-		log.Print("Ignoring invalid SlotFileExtension - unrecognized Url: %#v", s)
-		return nil
+		return &ParseError{Kind: ParseErrorUnknownExtension, Message: fmt.Sprintf("unrecognized extension url '%s'", s.Url)}
 	}
 }
 
-// Serializes SlotFile and writes to the slots table.
-func (s *SlotFile) Write(db *sql.DB) error {
-	start, err := time.Parse(ISO8601TimeFormat, s.Start)
+// Serializes SlotFile, parsed from line, and writes to the slots table.
+// Schedules must be written first, so that the slot's schedule can be resolved.
+func (s *SlotFile) Write(db *sql.DB, line *ParsedLine) error {
+	file := line.File
+	start, err := ParseInstant(s.Start)
 	if err != nil {
-		log.Printf("Ignoring bad ISO8601 timestamp in SlotFile.Start: %#v", s)
-		start = time.Time{}
+		return s.WriteRejected(db, line, "start", err.Error())
 	}
+	end, err := ParseInstant(s.End)
+	if err != nil {
+		return s.WriteRejected(db, line, "end", err.Error())
+	}
+	if end.Before(start) {
+		return s.WriteRejected(db, line, "end", fmt.Sprintf("is before start. Got '%s'", s.End))
+	}
+	_, startOffset := start.Zone()
+	_, endOffset := end.Zone()
 
-	end, err := time.Parse(ISO8601TimeFormat, s.End)
+	scheduleId, dangling, err := ResolveReference(db, "schedules", "schedule_id", "Schedule", s.Schedule.Reference, file.ManifestId)
 	if err != nil {
-		log.Printf("Ignoring bad ISO8601 timestamp in SlotFile.End: %#v", s)
-		end = time.Time{}
+		return err
 	}
 
 	res, err := db.Exec(`INSERT INTO
-      slots (id, schedule_reference, status, start_sec, end_sec)
-      VALUES (?, ?, ?, ?, ?)`,
-		s.Id, s.Schedule.Reference, s.Status, start.Unix(), end.Unix())
+      slots (id, schedule_reference, schedule_id, status,
+             start_sec, start_utc_offset_sec, start_local_date, end_sec, end_utc_offset_sec, end_local_date,
+             manifest_id, publisher, manifest_url, file_url, line_number, crawl_time_ms)
+      VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		s.Id, s.Schedule.Reference, scheduleId, s.Status,
+		start.Unix(), startOffset, start.Format("2006-01-02"), end.Unix(), endOffset, end.Format("2006-01-02"),
+		file.ManifestId,
+		file.Publisher, file.ManifestUrl, file.Url, line.Number, file.FetchStartMs)
+	if isDuplicateResource(err) {
+		return duplicateResourceError(line, s.Id)
+	}
 	if err != nil {
 		return err
 	}
@@ -541,8 +963,14 @@ func (s *SlotFile) Write(db *sql.DB) error {
 		return err
 	}
 
+	if dangling != "" {
+		if err := WriteDanglingReference(db, "slot_id", slotId, s.Schedule.Reference, dangling, file.ManifestId); err != nil {
+			return err
+		}
+	}
+
 	for _, v := range s.Extension {
-		if err := v.Write(db, slotId); err != nil {
+		if err := WriteParseError(db, line, v.Write(db, slotId)); err != nil {
 			return err
 		}
 	}
@@ -553,20 +981,21 @@ func (s *SlotFile) Write(db *sql.DB) error {
 /* Program */
 
 // OpenOutput opens the specified outputFilename and loads schema into the file.
-// outputFilename must not exist.
+// The database is written into outputFilename+publish.PartialSuffix until published with publish.Output.
 // Returns the opened database, the actual filename, and error.
 func OpenOutput(outputFilenameTemplate, schema string) (*sql.DB, string, error) {
 	outputFilename := strings.ReplaceAll(
 		outputFilenameTemplate, "VERSION", fmt.Sprintf("%d", time.Now().Unix()))
+	partialFilename := outputFilename + publish.PartialSuffix
 
-	_ = os.Remove(outputFilename)
-	outputFile, err := os.Create(outputFilename)
+	_ = os.Remove(partialFilename)
+	outputFile, err := os.Create(partialFilename)
 	if err != nil {
 		return nil, "", err
 	}
 	outputFile.Close()
 
-	odb, err := sql.Open("sqlite3", outputFilename)
+	odb, err := sql.Open("sqlite3", partialFilename)
 	if err != nil {
 		return nil, "", err
 	}
@@ -580,48 +1009,237 @@ func OpenOutput(outputFilenameTemplate, schema string) (*sql.DB, string, error)
 	return odb, outputFilename, nil
 }
 
-// ReadFileHandleLine executes query on input. The query must select
-// two string columns. The second string column is then split by '\n' and
-// passed into handle. Any errors returned by handle immediately terminates
-// the read and is returned by ReadFileHandleLine.
-func ReadFileHandleLine(input *sql.DB, query string,
-	handle func(int, []byte) error) error {
-	rows, err := input.Query(query)
+// CrawlerFileTable is a leaf file table in the crawler output.
+type CrawlerFileTable struct {
+	// The file table, e.g. "locations".
+	Table string
+
+	// The table holding the lines of files stored with --storage=lines, e.g. "location_lines".
+	LinesTable string
+
+	// The file table's primary key, e.g. "location_id".
+	IdColumn string
+}
+
+// ReadFileHandleLine reads every file of table crawled by crawl run runId in input, and passes the
+// file and each non-empty line with its 1-based line number into handle. Files are read line by
+// line, with lines longer than maxLineBytes failing the read. The files of each manifest are read
+// newest first, and files fetched in the same millisecond in the order the crawler stored them. This
+// order decides which resource is kept when several have the same id: files fetched by an incremental
+// crawl are read before the previous crawl's files copied beside them. Files with the same contents as a file of the same manifest already read
+// are skipped, as are files without a hash, which the crawler did not finish storing. Any errors
+// returned by handle immediately terminates the read and is returned by ReadFileHandleLine.
+func ReadFileHandleLine(input *sql.DB, table CrawlerFileTable, runId int64, maxLineBytes int,
+	handle func(*CrawledFile, int, []byte) error) error {
+	rows, err := input.Query(
+		fmt.Sprintf(`SELECT f.%s, f.manifest_id, f.url, f.storage, f.sha256, f.contents, f.fetch_start_ms,
+        f.fetch_start_ms < m.fetch_start_ms, m.url, p.name
+      FROM %s f
+      JOIN manifests m ON m.manifest_id = f.manifest_id
+      JOIN publishers p ON p.publisher_id = m.publisher_id
+      WHERE f.crawl_run_id = ? AND f.sha256 <> ''
+      ORDER BY f.manifest_id, f.fetch_start_ms DESC, f.%s`, table.IdColumn, table.Table, table.IdColumn),
+		runId)
 	if err != nil {
 		return err
 	}
 	defer rows.Close()
 
+	// Maps manifest_id -> SHA-256 of the manifest's files read so far.
+	processed := make(map[int64]map[string]bool)
 	for rows.Next() {
-		var url, contents string
-		if err := rows.Scan(&url, &contents); err != nil {
+		var id int64
+		var file CrawledFile
+		var storage, hash string
+		var contents sql.NullString
+		if err := rows.Scan(&id, &file.ManifestId, &file.Url, &storage, &hash, &contents,
+			&file.FetchStartMs, &file.Previous, &file.ManifestUrl, &file.Publisher); err != nil {
 			return err
 		}
-		log.Printf("Processing %s.", url)
+		if processed[file.ManifestId] == nil {
+			processed[file.ManifestId] = make(map[string]bool)
+		}
+		if processed[file.ManifestId][hash] {
+			log.Printf("Skipping %s - identical to a file of the same manifest already processed.", file.Url)
+			continue
+		}
+		processed[file.ManifestId][hash] = true
+		log.Printf("Processing %s.", file.Url)
+		handleLine := func(lineNumber int, line []byte) error {
+			return handle(&file, lineNumber, line)
+		}
 
-		for index, c := range strings.Split(contents, "\n") {
-			if err := handle(index, []byte(c)); err != nil {
-				return err
-			}
+		switch storage {
+		case "lines":
+			err = readLines(input, table, id, handleLine)
+		case "blob":
+			err = readBlob(input, hash, maxLineBytes, handleLine)
+		default:
+			err = scanLines(strings.NewReader(contents.String), maxLineBytes, handleLine)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %s", file.Url, err)
 		}
 	}
 
 	return rows.Err()
 }
 
+// readBlob decompresses the blob with the given hash and passes each non-empty line into handle.
+func readBlob(input *sql.DB, hash string, maxLineBytes int, handle func(int, []byte) error) error {
+	var compression string
+	var data []byte
+	if err := input.QueryRow(
+		"SELECT compression, data FROM blobs WHERE sha256 = ?", hash).Scan(&compression, &data); err != nil {
+		return err
+	}
+
+	var r io.Reader = bytes.NewReader(data)
+	switch compression {
+	case "none":
+	case "gzip":
+		gr, err := gzip.NewReader(r)
+		if err != nil {
+			return err
+		}
+		defer gr.Close()
+		r = gr
+	case "zstd":
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		r = zr
+	default:
+		return fmt.Errorf("unknown blob compression '%s'", compression)
+	}
+	return scanLines(r, maxLineBytes, handle)
+}
+
+// scanLines passes each non-empty line of r into handle.
+func scanLines(r io.Reader, maxLineBytes int, handle func(int, []byte) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxLineBytes)
+
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := bytes.TrimSuffix(scanner.Bytes(), []byte("\r"))
+		if len(line) == 0 {
+			continue
+		}
+		if err := handle(lineNumber, line); err != nil {
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		if err == bufio.ErrTooLong {
+			return fmt.Errorf("line %d longer than %d bytes", lineNumber+1, maxLineBytes)
+		}
+		return err
+	}
+	return nil
+}
+
+// readLines passes each line of file id, stored in table's lines table, into handle.
+func readLines(input *sql.DB, table CrawlerFileTable, id int64, handle func(int, []byte) error) error {
+	rows, err := input.Query(
+		fmt.Sprintf("SELECT line_number, contents FROM %s WHERE %s = ? ORDER BY line_number",
+			table.LinesTable, table.IdColumn),
+		id)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var lineNumber int
+		var line []byte
+		if err := rows.Scan(&lineNumber, &line); err != nil {
+			return err
+		}
+		if err := handle(lineNumber, line); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// ParseStats tracks statistics about the parse.
+// Not thread safe.
+type ParseStats struct {
+	// Maps resource type -> number of lines parsed.
+	resourceTypeToLines map[string]int
+
+	// Maps resource type -> number of lines with parse errors.
+	resourceTypeToErrorLines map[string]int
+
+	// Maps resource type -> parse error kind -> count.
+	resourceTypeToKindToCount map[string]map[string]int
+}
+
+// Record a parsed line, and its parse errors.
+func (p *ParseStats) RecordLine(line *ParsedLine) {
+	if p.resourceTypeToLines == nil {
+		p.resourceTypeToLines = make(map[string]int)
+		p.resourceTypeToErrorLines = make(map[string]int)
+		p.resourceTypeToKindToCount = make(map[string]map[string]int)
+	}
+	p.resourceTypeToLines[line.ResourceType]++
+	if len(line.ErrorKinds) == 0 {
+		return
+	}
+	p.resourceTypeToErrorLines[line.ResourceType]++
+	if p.resourceTypeToKindToCount[line.ResourceType] == nil {
+		p.resourceTypeToKindToCount[line.ResourceType] = make(map[string]int)
+	}
+	for _, kind := range line.ErrorKinds {
+		p.resourceTypeToKindToCount[line.ResourceType][kind]++
+	}
+}
+
+// Returns the fraction of lines with parse errors. 0 if no lines were parsed.
+func (p *ParseStats) ErrorRate() float64 {
+	lines, errorLines := 0, 0
+	for k, v := range p.resourceTypeToLines {
+		lines += v
+		errorLines += p.resourceTypeToErrorLines[k]
+	}
+	if lines == 0 {
+		return 0
+	}
+	return float64(errorLines) / float64(lines)
+}
+
+// Returns pretty printed stats.
+func (p *ParseStats) String() string {
+	o := "\n\n\nParsed lines by resource type (lines with parse errors):\n"
+	for _, resourceType := range []string{"Location", "Schedule", "Slot"} {
+		o += fmt.Sprintf("%s:\t%d (%d)\n", resourceType, p.resourceTypeToLines[resourceType], p.resourceTypeToErrorLines[resourceType])
+	}
+	o += fmt.Sprintf("\nError rate: %.2f%%\n", 100*p.ErrorRate())
+	for _, resourceType := range []string{"Location", "Schedule", "Slot"} {
+		kindToCount := p.resourceTypeToKindToCount[resourceType]
+		if len(kindToCount) == 0 {
+			continue
+		}
+		o += fmt.Sprintf("\n%s parse errors by kind:\n", resourceType)
+		for k, v := range kindToCount {
+			o += fmt.Sprintf("%s:\t%d\n", k, v)
+		}
+	}
+	return o
+}
+
 func Run() error {
 	inputFile := *crawlerOutputFile
 	if inputFile == "" {
-		pattern := "/tmp/crawler_output.*.sqlite"
-		files, err := filepath.Glob(pattern)
-		if err != nil {
-			return fmt.Errorf("cannot find crawler output file matching '%s': %s", pattern, err)
+		// Resolve the symlink so that crawls published while parsing don't change the input.
+		var err error
+		if inputFile, err = filepath.EvalSymlinks(*latestCrawlerOutput); err != nil {
+			return fmt.Errorf("cannot find the latest crawler output '%s': did you run the crawler? %s", *latestCrawlerOutput, err)
 		}
-		if len(files) == 0 {
-			return fmt.Errorf("cannot find crawler output file matching '%s': did you run the crawler?", pattern)
-		}
-		sort.Strings(files)
-		inputFile = files[len(files)-1]
 	} else {
 		_, err := os.Stat(inputFile)
 		if os.IsNotExist(err) {
@@ -629,7 +1247,7 @@ func Run() error {
 		}
 	}
 
-  log.Printf("Opening input file %s.", inputFile)
+	log.Printf("Opening input file %s.", inputFile)
 	crawlerOutput, err := sql.Open("sqlite3", inputFile)
 	if err != nil {
 		return err
@@ -642,57 +1260,83 @@ func Run() error {
 	}
 	defer odb.Close()
 
+	runId := *crawlRunId
+	if runId == 0 {
+		if err := crawlerOutput.QueryRow("SELECT MAX(crawl_run_id) FROM crawl_runs WHERE status = 'complete'").Scan(&runId); err != nil {
+			return fmt.Errorf("cannot find the latest complete crawl run in %s: %s", inputFile, err)
+		}
+	}
+	log.Printf("Parsing crawl run %d.", runId)
+
 	start := time.Now()
+	stats := &ParseStats{}
+	// handleResource returns a ReadFileHandleLine handler which parses each line as a resource of
+	// resourceType with parse, recording its parse errors.
+	handleResource := func(resourceType string, parse func(line *ParsedLine) error) func(*CrawledFile, int, []byte) error {
+		return func(file *CrawledFile, lineNumber int, contents []byte) error {
+			line := &ParsedLine{File: file, Number: lineNumber, Contents: contents, ResourceType: resourceType}
+			err := WriteParseError(odb, line, parse(line))
+			stats.RecordLine(line)
+			return err
+		}
+	}
+
 	log.Print("Parsing locations")
 	if err := ReadFileHandleLine(
-		crawlerOutput, "SELECT url, contents FROM locations",
-		func(lineNumber int, line []byte) error {
+		crawlerOutput, CrawlerFileTable{Table: "locations", LinesTable: "location_lines", IdColumn: "location_id"}, runId, *maxLineBytes,
+		handleResource("Location", func(line *ParsedLine) error {
 			var r LocationFile
-			if err := json.Unmarshal(line, &r); err != nil {
-				log.Printf("Unable to unmarshal line %d << %s >> %s", lineNumber, string(line), err)
-				return nil
+			if err := json.Unmarshal(line.Contents, &r); err != nil {
+				return &ParseError{Kind: ParseErrorMalformedJson, Message: err.Error()}
 			}
-			return r.Write(odb)
-		}); err != nil {
+			return r.Write(odb, line)
+		})); err != nil {
 		return err
 	}
 
 	log.Print("Parsing schedules")
 	if err := ReadFileHandleLine(
-		crawlerOutput, "SELECT url, contents FROM schedules",
-		func(lineNumber int, line []byte) error {
+		crawlerOutput, CrawlerFileTable{Table: "schedules", LinesTable: "schedule_lines", IdColumn: "schedule_id"}, runId, *maxLineBytes,
+		handleResource("Schedule", func(line *ParsedLine) error {
 			var r ScheduleFile
-			if err := json.Unmarshal(line, &r); err != nil {
-				log.Printf("Unable to unmarshal line %d: %s.", lineNumber, string(line))
-				return nil
+			if err := json.Unmarshal(line.Contents, &r); err != nil {
+				return &ParseError{Kind: ParseErrorMalformedJson, Message: err.Error()}
 			}
-			return r.Write(odb)
-		}); err != nil {
+			return r.Write(odb, line)
+		})); err != nil {
 		return err
 	}
 
 	log.Print("Parsing slots")
 	if err := ReadFileHandleLine(
-		crawlerOutput, "SELECT url, contents FROM slots",
-		func(lineNumber int, line []byte) error {
+		crawlerOutput, CrawlerFileTable{Table: "slots", LinesTable: "slot_lines", IdColumn: "slot_id"}, runId, *maxLineBytes,
+		handleResource("Slot", func(line *ParsedLine) error {
 			var r SlotFile
-			if err := json.Unmarshal(line, &r); err != nil {
-				log.Printf("Unable to unmarshal line %d: %s.", lineNumber, string(line))
-				return nil
+			if err := json.Unmarshal(line.Contents, &r); err != nil {
+				return &ParseError{Kind: ParseErrorMalformedJson, Message: err.Error()}
 			}
-			return r.Write(odb)
-		}); err != nil {
+			return r.Write(odb, line)
+		})); err != nil {
 		return err
 	}
 
 	log.Printf("Parsed and wrote in %s",
 		time.Since(start).String())
+	log.Print(stats)
+	if *strict && stats.ErrorRate() > *maxErrorRate {
+		return fmt.Errorf("%.2f%% of lines have parse errors, more than --max_error_rate=%.2f%%; see the parse_errors table in %s",
+			100*stats.ErrorRate(), 100**maxErrorRate, outputFilename+publish.PartialSuffix)
+	}
+	if err := publish.Output(odb, outputFilename, *latest); err != nil {
+		return fmt.Errorf("cannot publish %s: %s", outputFilename, err)
+	}
 	log.Printf("Wrote output to %s.", outputFilename)
 
 	return nil
 }
 
 func main() {
+	flag.Parse()
 	if err := Run(); err != nil {
 		log.Fatal(err)
 	}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// crawlerOutputSchema is the subset of the crawler's output schema read by ReadFileHandleLine.
+const crawlerOutputSchema = `
+CREATE TABLE publishers(publisher_id INTEGER PRIMARY KEY, name TEXT NOT NULL);
+CREATE TABLE manifests(
+    manifest_id INTEGER PRIMARY KEY, publisher_id NOT NULL, url TEXT NOT NULL, fetch_start_ms INTEGER NOT NULL);
+CREATE TABLE locations(
+    location_id INTEGER PRIMARY KEY, crawl_run_id NOT NULL, url TEXT NOT NULL, manifest_id NOT NULL,
+    contents TEXT, storage TEXT NOT NULL, sha256 TEXT NOT NULL, fetch_start_ms INTEGER NOT NULL);
+`
+
+// crawledLocationFile is a row of the crawler's locations table.
+type crawledLocationFile struct {
+	url          string
+	name         string
+	fetchStartMs int64
+}
+
+// parseLocations parses a crawler output whose only manifest, fetched at manifestStartMs, lists files,
+// each holding the location "location-1" named name. Returns the parser output.
+func parseLocations(t *testing.T, manifestStartMs int64, files []crawledLocationFile) *sql.DB {
+	dir := t.TempDir()
+	input := openDatabase(t, filepath.Join(dir, "crawler_output.sqlite"), crawlerOutputSchema)
+	exec(t, input, "INSERT INTO publishers (publisher_id, name) VALUES (1, 'publisher')")
+	exec(t, input, "INSERT INTO manifests (manifest_id, publisher_id, url, fetch_start_ms) VALUES (1, 1, ?, ?)",
+		"https://publisher.example/$bulk-publish", manifestStartMs)
+	for i, f := range files {
+		contents, err := json.Marshal(map[string]string{"resourceType": "Location", "id": "location-1", "name": f.name})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Distinct hashes, so that no file is skipped as identical to another.
+		exec(t, input, `INSERT INTO locations (crawl_run_id, url, manifest_id, contents, storage, sha256, fetch_start_ms)
+        VALUES (1, ?, 1, ?, 'contents', ?, ?)`, f.url, string(contents), string(rune('a'+i)), f.fetchStartMs)
+	}
+
+	output := openDatabase(t, filepath.Join(dir, "parser_output.sqlite"), OutputSchema)
+	if err := ReadFileHandleLine(
+		input, CrawlerFileTable{Table: "locations", LinesTable: "location_lines", IdColumn: "location_id"}, 1, 1<<20,
+		func(file *CrawledFile, lineNumber int, contents []byte) error {
+			line := &ParsedLine{File: file, Number: lineNumber, Contents: contents, ResourceType: "Location"}
+			var r LocationFile
+			if err := json.Unmarshal(contents, &r); err != nil {
+				t.Fatal(err)
+			}
+			return WriteParseError(output, line, r.Write(output, line))
+		}); err != nil {
+		t.Fatal(err)
+	}
+	return output
+}
+
+func openDatabase(t *testing.T, filename, schema string) *sql.DB {
+	db, err := sql.Open("sqlite3", filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	exec(t, db, schema)
+	return db
+}
+
+func exec(t *testing.T, db *sql.DB, query string, args ...interface{}) {
+	if _, err := db.Exec(query, args...); err != nil {
+		t.Fatalf("%s: %s", query, err)
+	}
+}
+
+func TestDuplicateResourcePrecedence(t *testing.T) {
+	const manifestStartMs = 1000
+	for _, tc := range []struct {
+		name  string
+		files []crawledLocationFile
+		// The name and file_url of the location kept, and the file_urls of the duplicate_id parse errors.
+		wantName, wantUrl string
+		wantErrorUrls     []string
+	}{
+		{
+			name: "newest file first",
+			files: []crawledLocationFile{
+				{url: "https://publisher.example/a.ndjson", name: "old", fetchStartMs: 2000},
+				{url: "https://publisher.example/b.ndjson", name: "new", fetchStartMs: 3000},
+			},
+			wantName: "new", wantUrl: "https://publisher.example/b.ndjson",
+			wantErrorUrls: []string{"https://publisher.example/a.ndjson"},
+		},
+		{
+			name: "same millisecond in stored order",
+			files: []crawledLocationFile{
+				{url: "https://publisher.example/b.ndjson", name: "first", fetchStartMs: 2000},
+				{url: "https://publisher.example/a.ndjson", name: "second", fetchStartMs: 2000},
+			},
+			wantName: "first", wantUrl: "https://publisher.example/b.ndjson",
+			wantErrorUrls: []string{"https://publisher.example/a.ndjson"},
+		},
+		{
+			// An incremental crawl's delta, and the previous crawl's file copied beside it.
+			name: "previous crawl superseded",
+			files: []crawledLocationFile{
+				{url: "https://publisher.example/a.ndjson", name: "delta", fetchStartMs: 2000},
+				{url: "https://publisher.example/a.ndjson", name: "previous", fetchStartMs: 500},
+			},
+			wantName: "delta", wantUrl: "https://publisher.example/a.ndjson",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			output := parseLocations(t, manifestStartMs, tc.files)
+			var name, fileUrl string
+			if err := output.QueryRow("SELECT name, file_url FROM locations WHERE id = 'location-1'").Scan(&name, &fileUrl); err != nil {
+				t.Fatal(err)
+			}
+			if name != tc.wantName || fileUrl != tc.wantUrl {
+				t.Errorf("kept location %q from %s, want %q from %s", name, fileUrl, tc.wantName, tc.wantUrl)
+			}
+
+			rows, err := output.Query("SELECT file_url FROM parse_errors WHERE kind = ? ORDER BY file_url", ParseErrorDuplicateId)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer rows.Close()
+			var errorUrls []string
+			for rows.Next() {
+				var u string
+				if err := rows.Scan(&u); err != nil {
+					t.Fatal(err)
+				}
+				errorUrls = append(errorUrls, u)
+			}
+			if !reflect.DeepEqual(errorUrls, tc.wantErrorUrls) {
+				t.Errorf("duplicate_id errors in %q, want %q", errorUrls, tc.wantErrorUrls)
+			}
+		})
+	}
+}